@@ -0,0 +1,272 @@
+package vf
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/shared/structs"
+
+	"github.com/david-gurley/host"
+)
+
+const (
+	aerCorrectable = "aer_dev_correctable"
+	aerNonfatal    = "aer_dev_nonfatal"
+	aerFatal       = "aer_dev_fatal"
+)
+
+var (
+	// aerFiles are the sysfs aer counter files, with the line holding their
+	// total
+	aerFiles = []struct {
+		name  string
+		total string
+	}{
+		{aerCorrectable, "TOTAL_ERR_COR"},
+		{aerNonfatal, "TOTAL_ERR_NONFATAL"},
+		{aerFatal, "TOTAL_ERR_FATAL"},
+	}
+)
+
+// aerCounters are the aer error totals of a pci device, keyed by sysfs file
+type aerCounters map[string]uint64
+
+// readAerCounters reads the aer counters of a pci device, or returns nil when
+// the device or kernel does not report aer
+func readAerCounters(address string) aerCounters {
+	counters := make(aerCounters)
+	for _, f := range aerFiles {
+		total, err := readAerTotal(pciDevicePath(address, f.name), f.total)
+		if err != nil {
+			continue
+		}
+		counters[f.name] = total
+	}
+	if len(counters) == 0 {
+		return nil
+	}
+	return counters
+}
+
+// readAerTotal returns the total line of an aer counter file, or the sum of
+// its counters on kernels without a total line
+func readAerTotal(path string, totalName string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var sum uint64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if fields[0] == totalName {
+			return v, nil
+		}
+		sum += v
+	}
+	return sum, scanner.Err()
+}
+
+// String lists the counters, e.g. "correctable 12, nonfatal 0, fatal 1"
+func (c aerCounters) String() string {
+	parts := make([]string, 0, len(aerFiles))
+	for _, f := range aerFiles {
+		if v, ok := c[f.name]; ok {
+			parts = append(parts, fmt.Sprintf("%s %d", strings.TrimPrefix(f.name, "aer_dev_"), v))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// statAttributes adds the counters to the stats of a device, prefixed with
+// prefix
+func (c aerCounters) statAttributes(attrs map[string]*structs.StatValue, prefix string) {
+	for _, f := range aerFiles {
+		v, ok := c[f.name]
+		if !ok {
+			continue
+		}
+		attrs[prefix+f.name] = &structs.StatValue{
+			Desc:            fmt.Sprintf("AER %s errors", strings.TrimPrefix(f.name, "aer_dev_")),
+			IntNumeratorVal: uint64ToInt64Ptr(&v),
+			Unit:            "Errors",
+		}
+	}
+}
+
+type aerSample struct {
+	counters  aerCounters
+	timestamp time.Time
+}
+
+// aerMonitor turns the aer counters sampled on every fingerprint into error
+// rates and compares them with the configured thresholds, in errors per
+// minute. A negative threshold disables the check.
+//
+// A device exceeding the fatal threshold stays faulted until its fatal
+// counter drops, i.e. the device was reset or removed, or an operator removes
+// its fault file from faultDir. Without faultDir the faults are only kept in
+// memory.
+type aerMonitor struct {
+	thresholds map[string]float64
+	samples    map[string]*aerSample
+	faultDir   string
+	faults     map[string]uint64
+}
+
+func newAerMonitor(correctable float64, nonfatal float64, fatal float64, faultDir string) *aerMonitor {
+	return &aerMonitor{
+		thresholds: map[string]float64{
+			aerCorrectable: correctable,
+			aerNonfatal:    nonfatal,
+			aerFatal:       fatal,
+		},
+		samples:  make(map[string]*aerSample),
+		faultDir: faultDir,
+		faults:   make(map[string]uint64),
+	}
+}
+
+// faultPath is the fault file of a device, holding the fatal counter it
+// faulted at
+func (m *aerMonitor) faultPath(address string) string {
+	return filepath.Join(m.faultDir, address)
+}
+
+// fault returns the fatal counter a faulted device was latched at
+func (m *aerMonitor) fault(address string) (uint64, bool) {
+	if fatal, ok := m.faults[address]; ok {
+		return fatal, true
+	}
+	if m.faultDir == "" {
+		return 0, false
+	}
+	b, err := ioutil.ReadFile(m.faultPath(address))
+	if err != nil {
+		return 0, false
+	}
+	fatal, _ := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	return fatal, true
+}
+
+// latch records a fatal fault, in memory when the fault file can not be
+// written
+func (m *aerMonitor) latch(address string, fatal uint64) {
+	if m.faultDir != "" {
+		err := os.MkdirAll(m.faultDir, 0755)
+		if err == nil {
+			err = ioutil.WriteFile(m.faultPath(address), []byte(fmt.Sprintf("%d\n", fatal)), 0644)
+		}
+		if err == nil {
+			return
+		}
+	}
+	m.faults[address] = fatal
+}
+
+// clear drops the fault of a device
+func (m *aerMonitor) clear(address string) {
+	delete(m.faults, address)
+	if m.faultDir != "" {
+		os.Remove(m.faultPath(address))
+	}
+}
+
+// Check samples the counters of the given pci devices and returns the health
+// description of the ones whose error rate exceeds a threshold, or that are
+// faulted. The first sample of a device only sets its baseline.
+func (m *aerMonitor) Check(addresses []string, now time.Time) map[string]string {
+	descs := make(map[string]string)
+	samples := make(map[string]*aerSample, len(addresses))
+	for _, address := range addresses {
+		if _, ok := samples[address]; ok {
+			continue
+		}
+		counters := readAerCounters(address)
+		if counters == nil {
+			continue
+		}
+		samples[address] = &aerSample{counters, now}
+		exceeded, fatal := m.exceeded(address, counters, now)
+		if m.thresholds[aerFatal] >= 0 {
+			latched, faulted := m.fault(address)
+			switch {
+			case faulted && counters[aerFatal] < latched:
+				m.clear(address)
+			case faulted && !fatal:
+				exceeded = append(exceeded, m.faultDesc(address, latched))
+			case !faulted && fatal:
+				m.latch(address, counters[aerFatal])
+			}
+		}
+		if len(exceeded) != 0 {
+			descs[address] = fmt.Sprintf("aer errors on %s: %s (%s)", address, strings.Join(exceeded, ", "), counters)
+		}
+	}
+	m.samples = samples
+	return descs
+}
+
+// exceeded lists the error rates of a device over their threshold since the
+// previous sample, and whether the fatal one is
+func (m *aerMonitor) exceeded(address string, counters aerCounters, now time.Time) ([]string, bool) {
+	previous, ok := m.samples[address]
+	if !ok {
+		return nil, false
+	}
+	minutes := now.Sub(previous.timestamp).Minutes()
+	if minutes <= 0 {
+		return nil, false
+	}
+	var exceeded []string
+	fatal := false
+	for _, f := range aerFiles {
+		threshold := m.thresholds[f.name]
+		current, ok := counters[f.name]
+		if threshold < 0 || !ok || current < previous.counters[f.name] {
+			continue
+		}
+		rate := float64(current-previous.counters[f.name]) / minutes
+		if rate > threshold {
+			exceeded = append(exceeded, fmt.Sprintf("%s %.1f/min over %g/min",
+				strings.TrimPrefix(f.name, "aer_dev_"), rate, threshold))
+			fatal = fatal || f.name == aerFatal
+		}
+	}
+	return exceeded, fatal
+}
+
+// faultDesc describes a fault and how to clear it
+func (m *aerMonitor) faultDesc(address string, fatal uint64) string {
+	if _, ok := m.faults[address]; ok || m.faultDir == "" {
+		return fmt.Sprintf("fatal errors at %d, until the device is reset", fatal)
+	}
+	return fmt.Sprintf("fatal errors at %d, until the device is reset or %s is removed", fatal, m.faultPath(address))
+}
+
+// checkAer samples the aer counters of the vfs and their pfs
+func (d *VfDevicePlugin) checkAer(vfs host.Vfs) map[string]string {
+	addresses := make([]string, 0, 2*len(vfs))
+	for _, vf := range vfs {
+		addresses = append(addresses, vf.PfAddress, vf.Address)
+	}
+	descs := d.aerMonitor.Check(addresses, time.Now())
+	for address, desc := range descs {
+		d.logger.Warn("aer error rate over threshold", "device", address, "desc", desc)
+	}
+	return descs
+}
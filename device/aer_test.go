@@ -0,0 +1,85 @@
+package vf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeAerFatal(t *testing.T, address string, fatal int) {
+	t.Helper()
+	dir := pciDevicePath(address)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	counters := fmt.Sprintf("Undefined 0\nDLP 0\nSDES 0\nTLP 0\nFCP 0\nCmpltTO 0\nTOTAL_ERR_FATAL %d\n", fatal)
+	if err := ioutil.WriteFile(filepath.Join(dir, aerFatal), []byte(counters), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAerMonitorFatalFault(t *testing.T) {
+	defer func(previous string) { sysfsRoot = previous }(sysfsRoot)
+	sysfsRoot = t.TempDir()
+	faultDir := filepath.Join(t.TempDir(), "aer")
+	address := "0000:3b:00.0"
+	m := newAerMonitor(-1, -1, 0, faultDir)
+	now := time.Now()
+	check := func(fatal int) string {
+		t.Helper()
+		writeAerFatal(t, address, fatal)
+		now = now.Add(time.Minute)
+		return m.Check([]string{address}, now)[address]
+	}
+
+	if desc := check(1); desc != "" {
+		t.Errorf("expected the first sample to set the baseline, got %q", desc)
+	}
+	if desc := check(2); desc == "" {
+		t.Error("expected a new fatal error to fault the device")
+	}
+	if desc := check(2); desc == "" {
+		t.Error("expected the device to stay faulted without new errors")
+	}
+
+	// a restarted plugin picks up the fault file
+	m = newAerMonitor(-1, -1, 0, faultDir)
+	if desc := check(2); desc == "" {
+		t.Error("expected the fault to survive a restart")
+	}
+
+	if err := os.Remove(m.faultPath(address)); err != nil {
+		t.Fatal(err)
+	}
+	if desc := check(2); desc != "" {
+		t.Errorf("expected removing the fault file to clear the fault, got %q", desc)
+	}
+
+	if desc := check(3); desc == "" {
+		t.Error("expected a new fatal error to fault the device")
+	}
+	if desc := check(0); desc != "" {
+		t.Errorf("expected a counter reset to clear the fault, got %q", desc)
+	}
+	if _, err := os.Stat(m.faultPath(address)); !os.IsNotExist(err) {
+		t.Errorf("expected the fault file to be removed, got %v", err)
+	}
+}
+
+func TestAerMonitorFatalDisabled(t *testing.T) {
+	defer func(previous string) { sysfsRoot = previous }(sysfsRoot)
+	sysfsRoot = t.TempDir()
+	address := "0000:3b:00.1"
+	m := newAerMonitor(-1, -1, -1, "")
+	now := time.Now()
+	for _, fatal := range []int{1, 2, 2} {
+		writeAerFatal(t, address, fatal)
+		now = now.Add(time.Minute)
+		if desc := m.Check([]string{address}, now)[address]; desc != "" {
+			t.Errorf("expected no fault with the check disabled, got %q", desc)
+		}
+	}
+}
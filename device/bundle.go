@@ -0,0 +1,160 @@
+package vf
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/nomad/plugins/shared/hclspec"
+
+	"github.com/david-gurley/host"
+)
+
+const (
+	bundleDeviceType = "bundle"
+
+	// attributes for bundle device groups
+	BundleDistinctCardsAttr = "bundle_distinct_cards"
+)
+
+// bundleSpec is the hcl spec of the bundle block
+func bundleSpec() *hclspec.Spec {
+	return hclspec.NewBlock("bundle", false, hclspec.NewObject(map[string]*hclspec.Spec{
+		"name": hclspec.NewDefault(
+			hclspec.NewAttr("name", "string", false),
+			hclspec.NewLiteral("\"pair\""),
+		),
+		"vfs":            hclspec.NewAttr("vfs", "string", false),
+		"distinct_cards": hclspec.NewAttr("distinct_cards", "bool", false),
+		"pf_selector":    pfSelectorSpec(),
+	}))
+}
+
+// BundleConfig is the bundle block. The bundle claims the vfs with the given
+// indexes on every pf matched by its pf selectors, and pairs them across two
+// ports into devices of type bundle, advertised as generic/bundle/<name>.
+type BundleConfig struct {
+	Name          string             `codec:"name"`
+	Vfs           string             `codec:"vfs"`
+	DistinctCards bool               `codec:"distinct_cards"`
+	PfSelectors   []PfSelectorConfig `codec:"pf_selector"`
+}
+
+// bundler pairs the claimed vfs of two ports
+type bundler struct {
+	name          string
+	indexes       *indexSet
+	selectors     pfSelectors
+	distinctCards bool
+}
+
+// bundleCandidate is a vf claimed by the bundler
+type bundleCandidate struct {
+	vf    *host.Vf
+	index int
+}
+
+// newBundler validates the bundle block, a missing block disables bundles
+// and returns nil
+func newBundler(c BundleConfig) (*bundler, error) {
+	if c.Name == "" {
+		return nil, nil
+	}
+	if !poolNamePattern.MatchString(c.Name) {
+		return nil, fmt.Errorf("bundle: invalid name %q", c.Name)
+	}
+	indexes, err := parseIndexSet(c.Vfs)
+	if err != nil {
+		return nil, fmt.Errorf("bundle: invalid vfs %q: %v", c.Vfs, err)
+	}
+	selectors, err := newPfSelectors(c.PfSelectors)
+	if err != nil {
+		return nil, fmt.Errorf("bundle: %v", err)
+	}
+	return &bundler{
+		name:          c.Name,
+		indexes:       indexes,
+		selectors:     selectors,
+		distinctCards: c.DistinctCards,
+	}, nil
+}
+
+// Claims reports whether the vf with the given index on pf is bundled
+func (b *bundler) Claims(pf *host.Pf, index int) bool {
+	return b != nil && index >= 0 && b.indexes.Contains(index) && b.selectors.Matches(pf)
+}
+
+// Pair pairs the selected ports, in address order, each with the next
+// unpaired port, on another card when distinct cards are required. Only sr-iov
+// pfs with vfs passing the device filter, filtered, are paired. The vfs with
+// the same index on two paired ports form a bundle, so bundles stay the same
+// while some of them are allocated. Candidates without a partner are not
+// advertised.
+func (b *bundler) Pair(candidates []*bundleCandidate, pfsMap map[string]*host.Pf, filtered map[string]bool, ports map[string]*port, ids map[string]string) []*deviceInstance {
+	byPort := make(map[string]map[int]*host.Vf)
+	for _, c := range candidates {
+		if byPort[c.vf.PfAddress] == nil {
+			byPort[c.vf.PfAddress] = make(map[int]*host.Vf)
+		}
+		byPort[c.vf.PfAddress][c.index] = c.vf
+	}
+	// pair every selected pf, not only the ones with free vfs, so the pairs
+	// do not change as vfs get allocated
+	addresses := make([]string, 0)
+	for address, pf := range pfsMap {
+		if pf.TotalVfs > 0 && filtered[address] && b.selectors.Matches(pf) {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Strings(addresses)
+
+	bundles := make([]*deviceInstance, 0)
+	paired := make(map[string]bool)
+	for i, a := range addresses {
+		if paired[a] {
+			continue
+		}
+		for _, other := range addresses[i+1:] {
+			if paired[other] || !b.distinct(ports[a], ports[other]) {
+				continue
+			}
+			paired[a], paired[other] = true, true
+			for index, vf := range byPort[a] {
+				partner, ok := byPort[other][index]
+				if !ok {
+					continue
+				}
+				bundles = append(bundles, &deviceInstance{
+					ID:      deviceID(vf, ids) + "+" + deviceID(partner, ids),
+					Devices: host.Vfs{vf, partner},
+				})
+			}
+			break
+		}
+	}
+	sort.Slice(bundles, func(i, j int) bool {
+		return bundles[i].ID < bundles[j].ID
+	})
+	return bundles
+}
+
+// distinct reports whether two ports may be bundled
+func (b *bundler) distinct(p1 *port, p2 *port) bool {
+	if !b.distinctCards {
+		return true
+	}
+	return p1 != nil && p2 != nil && p1.Card != p2.Card
+}
+
+// Group returns the device group of the bundles
+func (b *bundler) Group(bundles []*deviceInstance) *GroupMapping {
+	group := &GroupMapping{
+		Vendor:  vendor,
+		Type:    bundleDeviceType,
+		Name:    b.name,
+		Bundles: bundles,
+	}
+	for _, bd := range bundles {
+		group.Devices = append(group.Devices, bd.Devices...)
+	}
+	return group
+}
@@ -0,0 +1,40 @@
+package vf
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/david-gurley/host"
+)
+
+func TestBundlerPairSkipsPfsWithoutVfs(t *testing.T) {
+	b, err := newBundler(BundleConfig{Name: "pair", Vfs: "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pfsMap := map[string]*host.Pf{
+		// onboard management nic without sr-iov
+		"0000:01:00.0": {Address: "0000:01:00.0"},
+		"0000:3b:00.0": {Address: "0000:3b:00.0", TotalVfs: 8},
+		// sr-iov pf whose vfs are all filtered out
+		"0000:5e:00.0": {Address: "0000:5e:00.0", TotalVfs: 8},
+		"0000:af:00.0": {Address: "0000:af:00.0", TotalVfs: 8},
+	}
+	filtered := map[string]bool{
+		"0000:01:00.0": true,
+		"0000:3b:00.0": true,
+		"0000:af:00.0": true,
+	}
+	vf1 := &host.Vf{Address: "0000:3b:02.0", PfAddress: "0000:3b:00.0"}
+	vf2 := &host.Vf{Address: "0000:af:02.0", PfAddress: "0000:af:00.0"}
+	candidates := []*bundleCandidate{{vf1, 0}, {vf2, 0}}
+
+	bundles := b.Pair(candidates, pfsMap, filtered, nil, nil)
+	expected := []*deviceInstance{{
+		ID:      "0000:3b:02.0+0000:af:02.0",
+		Devices: host.Vfs{vf1, vf2},
+	}}
+	if !reflect.DeepEqual(bundles, expected) {
+		t.Errorf("expected %+v, got %+v", expected, bundles)
+	}
+}
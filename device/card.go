@@ -0,0 +1,159 @@
+package vf
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/hashicorp/nomad/plugins/shared/structs"
+
+	"github.com/david-gurley/host"
+)
+
+const (
+	// attributes for device groups (card and port identity)
+	CardAttr          = "card"
+	CardSerialAttr    = "card_serial"
+	PortAttr          = "port"
+	BondAttr          = "bond"
+	BondMemberAttr    = "pf_bond_member"
+	SubinterfacesAttr = "pf_has_subinterfaces"
+)
+
+// card is a physical adapter. pfs are on the same card when they are
+// functions of the same pci slot, or report the same device serial number.
+type card struct {
+	ID     string
+	Serial string
+}
+
+// port is the identity of a pf: the card it is on and its bonding
+type port struct {
+	Card *card
+	// Serial is the device serial number of the pf itself
+	Serial        string
+	Name          string
+	Bond          string
+	BondMember    bool
+	Subinterfaces bool
+}
+
+// pfPorts computes the card and port identity of every pf. A card is named
+// after the slot of its lowest pf address, e.g. "0000:3b:00".
+func pfPorts(pfsMap map[string]*host.Pf) map[string]*port {
+	addresses := make([]string, 0, len(pfsMap))
+	for address := range pfsMap {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	// union the pfs sharing a slot or a serial number
+	parent := make(map[string]string, len(addresses))
+	var find func(string) string
+	find = func(a string) string {
+		if parent[a] != a {
+			parent[a] = find(parent[a])
+		}
+		return parent[a]
+	}
+	serials := make(map[string]string, len(addresses))
+	firstBy := make(map[string]string)
+	for _, address := range addresses {
+		parent[address] = address
+		serials[address] = pciDeviceSerial(address)
+		for _, key := range []string{"slot:" + pciSlot(address), "dsn:" + serials[address]} {
+			if key == "dsn:" {
+				continue
+			}
+			if first, ok := firstBy[key]; ok {
+				// keep the lowest address as the root
+				a, b := find(address), find(first)
+				if b < a {
+					a, b = b, a
+				}
+				parent[b] = a
+				continue
+			}
+			firstBy[key] = address
+		}
+	}
+
+	cards := make(map[string]*card)
+	ports := make(map[string]*port, len(addresses))
+	for _, address := range addresses {
+		root := find(address)
+		c, ok := cards[root]
+		if !ok {
+			c = &card{ID: pciSlot(root), Serial: serials[root]}
+			cards[root] = c
+		}
+		pf := pfsMap[address]
+		p := &port{
+			Card:          c,
+			Serial:        serials[address],
+			Name:          pf.InterfaceName,
+			Subinterfaces: pf.HasSubinterfaces,
+		}
+		if p.Name == "" {
+			p.Name = address
+		}
+		p.Bond = bondMaster(pf.InterfaceName)
+		p.BondMember = p.Bond != "" || pf.BondMember != 0
+		ports[address] = p
+	}
+	return ports
+}
+
+// bondMaster returns the bond an interface is enslaved to, or an empty
+// string. pf.BondMember only holds the 802.3ad aggregator id, which is zero
+// for the other bonding modes.
+func bondMaster(interfaceName string) string {
+	if interfaceName == "" {
+		return ""
+	}
+	master, err := os.Readlink(filepath.Join(sysfsRoot, "class", "net", interfaceName, "master"))
+	if err != nil {
+		return ""
+	}
+	name := filepath.Base(master)
+	if _, err := os.Stat(filepath.Join(sysfsRoot, "class", "net", name, "bonding")); err != nil {
+		return ""
+	}
+	return name
+}
+
+// portAttributes adds the card and port identity shared by every vf of a
+// device group
+func portAttributes(vfs host.Vfs, ports map[string]*port, attrs map[string]*structs.Attribute) {
+	var first *port
+	sameCard, samePort := true, true
+	for _, vf := range vfs {
+		p := ports[vf.PfAddress]
+		if p == nil {
+			return
+		}
+		if first == nil {
+			first = p
+			continue
+		}
+		samePort = samePort && p == first
+		sameCard = sameCard && p.Card == first.Card
+	}
+	if first == nil {
+		return
+	}
+	if sameCard {
+		attrs[CardAttr] = &structs.Attribute{String: &first.Card.ID}
+		if first.Card.Serial != "" {
+			attrs[CardSerialAttr] = &structs.Attribute{String: &first.Card.Serial}
+		}
+	}
+	if samePort {
+		attrs[PortAttr] = &structs.Attribute{String: &first.Name}
+		attrs[BondMemberAttr] = &structs.Attribute{Bool: &first.BondMember}
+		attrs[SubinterfacesAttr] = &structs.Attribute{Bool: &first.Subinterfaces}
+		if first.Bond != "" {
+			attrs[BondAttr] = &structs.Attribute{String: &first.Bond}
+		}
+	}
+}
@@ -3,6 +3,7 @@ package vf
 import (
 	"context"
 	"fmt"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -20,7 +21,7 @@ const (
 	pluginName    = "vf"
 	pluginVersion = "v0.1.0"
 	vendor        = "generic"
-	deviceType    = "vfio-pci"
+	deviceType    = "vf"
 )
 
 var (
@@ -44,30 +45,171 @@ var (
 			hclspec.NewAttr("fingerprint_period", "string", false),
 			hclspec.NewLiteral("\"1m\""),
 		),
+		"pci_ids_path":    hclspec.NewAttr("pci_ids_path", "string", false),
+		"pci_ids_overlay": hclspec.NewAttr("pci_ids_overlay", "string", false),
+		"grouping": hclspec.NewDefault(
+			hclspec.NewAttr("grouping", "string", false),
+			hclspec.NewLiteral("\"pf\""),
+		),
+		"split_numa": hclspec.NewDefault(
+			hclspec.NewAttr("split_numa", "bool", false),
+			hclspec.NewLiteral("true"),
+		),
+		"group_label":  hclspec.NewAttr("group_label", "string", false),
+		"group_vendor": hclspec.NewAttr("group_vendor", "string", false),
+		"group_type":   hclspec.NewAttr("group_type", "string", false),
+		"group_name":   hclspec.NewAttr("group_name", "string", false),
+		"resize_in_use": hclspec.NewDefault(
+			hclspec.NewAttr("resize_in_use", "string", false),
+			hclspec.NewLiteral("\"refuse\""),
+		),
+		"resize_timeout": hclspec.NewDefault(
+			hclspec.NewAttr("resize_timeout", "string", false),
+			hclspec.NewLiteral("\"5m\""),
+		),
+		"pf_features": hclspec.NewAttr("pf_features", "list(string)", false),
+		"preflight": hclspec.NewDefault(
+			hclspec.NewAttr("preflight", "bool", false),
+			hclspec.NewLiteral("true"),
+		),
+		"aer_correctable_rate": hclspec.NewDefault(
+			hclspec.NewAttr("aer_correctable_rate", "number", false),
+			hclspec.NewLiteral("-1"),
+		),
+		"aer_nonfatal_rate": hclspec.NewDefault(
+			hclspec.NewAttr("aer_nonfatal_rate", "number", false),
+			hclspec.NewLiteral("-1"),
+		),
+		"aer_fatal_rate": hclspec.NewDefault(
+			hclspec.NewAttr("aer_fatal_rate", "number", false),
+			hclspec.NewLiteral("0"),
+		),
+		"aer_fault_dir": hclspec.NewDefault(
+			hclspec.NewAttr("aer_fault_dir", "string", false),
+			hclspec.NewLiteral("\"/run/nomad-vf/aer\""),
+		),
+		"irq_affinity": hclspec.NewAttr("irq_affinity", "string", false),
+		"devlink": hclspec.NewDefault(
+			hclspec.NewAttr("devlink", "bool", false),
+			hclspec.NewLiteral("true"),
+		),
+		"ptp_device": hclspec.NewAttr("ptp_device", "bool", false),
+		"cni_dir": hclspec.NewDefault(
+			hclspec.NewAttr("cni_dir", "string", false),
+			hclspec.NewLiteral("\"/run/nomad-vf/cni\""),
+		),
+		"sriov_policy": hclspec.NewBlockList("sriov_policy", hclspec.NewObject(map[string]*hclspec.Spec{
+			"vendor_regexp": hclspec.NewDefault(
+				hclspec.NewAttr("vendor_regexp", "string", false),
+				hclspec.NewLiteral("\".*\""),
+			),
+			"num_vfs":      hclspec.NewAttr("num_vfs", "number", false),
+			"max_vfs":      hclspec.NewAttr("max_vfs", "bool", false),
+			"vfio":         hclspec.NewAttr("vfio", "bool", false),
+			"eswitch_mode": hclspec.NewAttr("eswitch_mode", "string", false),
+			"pf_selector":  pfSelectorSpec(),
+		})),
+		"pf_selector":  pfSelectorSpec(),
+		"pool":         poolSpec(),
+		"pf_labels":    pfLabelsSpec(),
+		"bundle":       bundleSpec(),
+		"guard":        guardSpec(),
+		"device_class": deviceClassSpec(),
+		"pf_device":    pfDeviceSpec(),
+		"include":      deviceSelectorSpec("include"),
+		"exclude":      deviceSelectorSpec("exclude"),
 	})
 )
 
 type Config struct {
-	Enabled           bool     `codec:"enabled"`
-	Vendors           []string `codec:"vendors"`
-	FingerprintPeriod string   `codec:"fingerprint_period"`
+	Enabled           bool                   `codec:"enabled"`
+	Vendors           []string               `codec:"vendors"`
+	FingerprintPeriod string                 `codec:"fingerprint_period"`
+	PciIdsPath        string                 `codec:"pci_ids_path"`
+	PciIdsOverlay     string                 `codec:"pci_ids_overlay"`
+	Grouping          string                 `codec:"grouping"`
+	SplitNuma         bool                   `codec:"split_numa"`
+	GroupLabel        string                 `codec:"group_label"`
+	GroupVendor       string                 `codec:"group_vendor"`
+	GroupType         string                 `codec:"group_type"`
+	GroupName         string                 `codec:"group_name"`
+	ResizeInUse       string                 `codec:"resize_in_use"`
+	ResizeTimeout     string                 `codec:"resize_timeout"`
+	PfFeatures        []string               `codec:"pf_features"`
+	Preflight         bool                   `codec:"preflight"`
+	AerCorrectable    float64                `codec:"aer_correctable_rate"`
+	AerNonfatal       float64                `codec:"aer_nonfatal_rate"`
+	AerFatal          float64                `codec:"aer_fatal_rate"`
+	AerFaultDir       string                 `codec:"aer_fault_dir"`
+	IrqAffinity       string                 `codec:"irq_affinity"`
+	Devlink           bool                   `codec:"devlink"`
+	PtpDevice         bool                   `codec:"ptp_device"`
+	CniDir            string                 `codec:"cni_dir"`
+	SriovPolicies     []SriovPolicyConfig    `codec:"sriov_policy"`
+	PfSelectors       []PfSelectorConfig     `codec:"pf_selector"`
+	Pools             []PoolConfig           `codec:"pool"`
+	PfLabels          []PfLabelsConfig       `codec:"pf_labels"`
+	Bundle            BundleConfig           `codec:"bundle"`
+	Guard             GuardConfig            `codec:"guard"`
+	DeviceClasses     []DeviceClassConfig    `codec:"device_class"`
+	PfDevices         []PfDeviceConfig       `codec:"pf_device"`
+	Include           []DeviceSelectorConfig `codec:"include"`
+	Exclude           []DeviceSelectorConfig `codec:"exclude"`
 }
 
 type VfDevicePlugin struct {
 	logger            log.Logger
 	enabled           bool
-	vendors           []string
+	classes           deviceClasses
+	pfDevices         pfDevices
+	filter            deviceFilter
+	guard             *guard
+	guarded           map[string]string
 	fingerprintPeriod time.Duration
-	devices           map[string]*host.Vf
+	pciNames          *pciNames
+	resizeInUse       string
+	resizeTimeout     time.Duration
+	features          []string
+	preflight         *preflight
+	preflightStatus   string
+	warnedUnsafe      bool
+	aerMonitor        *aerMonitor
+	irqPinner         *irqPinner
+	devlinkMonitor    *devlinkMonitor
+	ptpDevice         bool
+	cniDir            string
+	sriovPolicies     []*sriovPolicy
+	// deferredPfConfigs is only used by the fingerprint goroutine
+	deferredPfConfigs []*deferredPfConfig
+	pools             pools
+	bundler           *bundler
+	grouping          *grouping
+	splitNuma         bool
+	pfLabels          pfLabels
+	devices           map[string]host.Vfs
+	groups            map[string]*GroupMapping
+	ids               map[string]string
+	representors      map[string]string
+	ptp               map[string]*ptpInfo
+	vfPools           map[string]*pool
+	pfs               map[string]*host.Pf
 	deviceLock        sync.RWMutex
+	reservations      map[string]*reservation
+	reservationLock   sync.RWMutex
 }
 
 // initialize any map or slice attributes
 func NewPlugin(log log.Logger) *VfDevicePlugin {
+	grouping, _ := newGrouping(groupingPf, "", "", "", "")
 	return &VfDevicePlugin{
-		logger:  log.Named(pluginName),
-		devices: make(map[string]*host.Vf),
-		vendors: make([]string, 1),
+		grouping:       grouping,
+		preflight:      newPreflight(),
+		aerMonitor:     newAerMonitor(-1, -1, 0, ""),
+		devlinkMonitor: newDevlinkMonitor(),
+		logger:         log.Named(pluginName),
+		devices:        make(map[string]host.Vfs),
+		reservations:   make(map[string]*reservation),
+		pciNames:       &pciNames{},
 	}
 }
 
@@ -85,13 +227,131 @@ func (d *VfDevicePlugin) SetConfig(c *base.Config) error {
 		return err
 	}
 	d.enabled = config.Enabled
-	d.vendors = config.Vendors
+
+	for _, vendor := range config.Vendors {
+		if _, err := regexp.Compile(strings.ToLower(vendor)); err != nil {
+			return fmt.Errorf("invalid vendor %q: %v", vendor, err)
+		}
+	}
+	classes, err := newDeviceClasses(config.DeviceClasses)
+	if err != nil {
+		return err
+	}
+	d.classes = classes
+
+	pfDevices, err := newPfDevices(config.PfDevices)
+	if err != nil {
+		return err
+	}
+	d.pfDevices = pfDevices
+
+	selectors, err := newPfSelectors(config.PfSelectors)
+	if err != nil {
+		return err
+	}
+	include, err := newDeviceSelectors("include", config.Include)
+	if err != nil {
+		return err
+	}
+	exclude, err := newDeviceSelectors("exclude", config.Exclude)
+	if err != nil {
+		return err
+	}
+	d.filter = deviceFilter{
+		vendors:  config.Vendors,
+		include:  include,
+		exclude:  exclude,
+		pfFilter: selectors,
+	}
+
+	guard, err := newGuard(config.Guard)
+	if err != nil {
+		return err
+	}
+	d.guard = guard
 
 	period, err := time.ParseDuration(config.FingerprintPeriod)
 	if err != nil {
 		return fmt.Errorf("failed to parse doFingerprint period %q: %v", config.FingerprintPeriod, err)
 	}
 	d.fingerprintPeriod = period
+
+	names, err := loadPciNames(config.PciIdsPath, config.PciIdsOverlay)
+	if err != nil {
+		return err
+	}
+	if names.db == nil {
+		d.logger.Warn("no pci.ids database found, using built-in vendor and device names")
+	}
+	d.pciNames = names
+
+	switch config.ResizeInUse {
+	case resizeInUseRefuse, resizeInUseWait:
+		d.resizeInUse = config.ResizeInUse
+	default:
+		return fmt.Errorf("invalid resize_in_use %q, must be %q or %q", config.ResizeInUse, resizeInUseRefuse, resizeInUseWait)
+	}
+	resizeTimeout, err := time.ParseDuration(config.ResizeTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to parse resize timeout %q: %v", config.ResizeTimeout, err)
+	}
+	d.resizeTimeout = resizeTimeout
+
+	if err := validateFeatures(config.PfFeatures); err != nil {
+		return err
+	}
+	d.features = config.PfFeatures
+
+	d.preflight = nil
+	if config.Preflight {
+		d.preflight = newPreflight()
+	}
+	d.aerMonitor = newAerMonitor(config.AerCorrectable, config.AerNonfatal, config.AerFatal, config.AerFaultDir)
+
+	d.devlinkMonitor = nil
+	if config.Devlink {
+		d.devlinkMonitor = newDevlinkMonitor()
+	}
+
+	d.ptpDevice = config.PtpDevice
+	d.cniDir = config.CniDir
+
+	pinner, err := newIrqPinner(config.IrqAffinity)
+	if err != nil {
+		return err
+	}
+	d.irqPinner = pinner
+
+	policies, err := newSriovPolicies(config.SriovPolicies)
+	if err != nil {
+		return err
+	}
+	d.sriovPolicies = policies
+
+	pools, err := newPools(config.Pools)
+	if err != nil {
+		return err
+	}
+	d.pools = pools
+
+	bundler, err := newBundler(config.Bundle)
+	if err != nil {
+		return err
+	}
+	d.bundler = bundler
+
+	labels, err := newPfLabels(config.PfLabels)
+	if err != nil {
+		return err
+	}
+	d.pfLabels = labels
+
+	grouping, err := newGrouping(config.Grouping, config.GroupLabel, config.GroupVendor, config.GroupType, config.GroupName)
+	if err != nil {
+		return err
+	}
+	d.grouping = grouping
+	d.splitNuma = config.SplitNuma
 	d.logger.Info("config set", "config", log.Fmt("% #v", pretty.Formatter(config)))
 	return nil
 }
@@ -122,11 +382,26 @@ func (d *VfDevicePlugin) Reserve(deviceIDs []string) (*device.ContainerReservati
 	}
 
 	d.deviceLock.RLock()
+	pfs := d.pfs
+	ids := d.ids
+	representors := d.representors
+	ptp := d.ptp
+	vfPools := d.vfPools
 	var notExistingIDs []string
+	reserved := make(host.Vfs, 0, len(deviceIDs))
+	bundles := make(map[string]string)
 	for _, deviceId := range deviceIDs {
-		if _, deviceIDExists := d.devices[deviceId]; !deviceIDExists {
+		vfs, deviceIDExists := d.devices[deviceId]
+		if !deviceIDExists {
 			notExistingIDs = append(notExistingIDs, deviceId)
+			continue
+		}
+		if len(vfs) > 1 {
+			for _, vf := range vfs {
+				bundles[vf.Address] = deviceId
+			}
 		}
+		reserved = append(reserved, vfs...)
 	}
 
 	d.deviceLock.RUnlock()
@@ -135,12 +410,48 @@ func (d *VfDevicePlugin) Reserve(deviceIDs []string) (*device.ContainerReservati
 	}
 
 	envs := make(map[string]string)
-	for i, id := range deviceIDs {
-		envs[fmt.Sprintf("DEVICE_VF_%s_%d", d.devices[id].Vendor, i)] = id
-
+	for i, vf := range reserved {
+		envs[fmt.Sprintf("DEVICE_VF_%s_%d", vf.Vendor, i)] = vf.Address
+		envs[fmt.Sprintf("%s%d", deviceIDEnv, i)] = deviceID(vf, ids)
 	}
+	manifest, err := d.reservationManifest(reserved, ids, pfs, bundles, representors, ptp)
+	if err != nil {
+		return nil, err
+	}
+	envs[manifestEnv] = manifest
+	for k, v := range numaEnvs(reserved) {
+		envs[k] = v
+	}
+	for k, v := range representorEnvs(reserved, representors) {
+		envs[k] = v
+	}
+	netdeviceEnvs, err := netdeviceReservation(reserved, ids, vfPools, pfs, d.cniDir)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range netdeviceEnvs {
+		envs[k] = v
+	}
+	// only record the reservation once nothing can fail anymore
+	d.recordReservations(reserved, ids, vfPools)
+	d.pinReservedIrqs()
 
-	return &device.ContainerReservation{
+	reservation := &device.ContainerReservation{
 		Envs: envs,
-	}, nil
+	}
+	if d.ptpDevice {
+		reservation.Devices = ptpDevices(reserved, ptp)
+	}
+	dpdkMounts, dpdkDevices, dpdkEnvs := dpdkReservation(vfsInMode(reserved, vfPools, poolModeDpdk))
+	reservation.Mounts = append(reservation.Mounts, dpdkMounts...)
+	reservation.Devices = append(reservation.Devices, dpdkDevices...)
+	for k, v := range dpdkEnvs {
+		envs[k] = v
+	}
+	rdmaDevices, rdmaEnvs := rdmaReservation(reserved)
+	reservation.Devices = append(reservation.Devices, rdmaDevices...)
+	for k, v := range rdmaEnvs {
+		envs[k] = v
+	}
+	return reservation, nil
 }
@@ -0,0 +1,297 @@
+package vf
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/hashicorp/nomad/plugins/shared/structs"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+
+	"github.com/david-gurley/host"
+)
+
+const (
+	// attributes for device groups (devlink info), the fixed and running
+	// versions are added as pf_devlink_<name>, e.g. fw.psid as
+	// pf_devlink_fw_psid, apart from the other pf attributes
+	DevlinkSerialAttr      = "pf_serial_number"
+	DevlinkBoardSerialAttr = "pf_board_serial"
+	devlinkVersionPrefix   = "pf_devlink_"
+)
+
+// devlinkInfo is the devlink dev info of a device
+type devlinkInfo struct {
+	Driver      string
+	Serial      string
+	BoardSerial string
+	Fixed       map[string]string
+	Running     map[string]string
+	Stored      map[string]string
+}
+
+// devlinkHealthReporter is the state of a devlink health reporter, e.g.
+// fw_fatal or tx
+type devlinkHealthReporter struct {
+	Name         string
+	Healthy      bool
+	ErrorCount   uint64
+	RecoverCount uint64
+}
+
+// devlinkClient queries the devlink generic netlink family
+type devlinkClient struct {
+	family uint16
+}
+
+func newDevlinkClient() (*devlinkClient, error) {
+	f, err := netlink.GenlFamilyGet(unix.DEVLINK_GENL_NAME)
+	if err != nil {
+		return nil, err
+	}
+	return &devlinkClient{family: f.ID}, nil
+}
+
+// request runs a devlink command on a pci device and returns the raw replies
+func (c *devlinkClient) request(cmd uint8, flags int, address string) ([][]byte, error) {
+	req := nl.NewNetlinkRequest(int(c.family), unix.NLM_F_REQUEST|unix.NLM_F_ACK|flags)
+	req.AddData(&nl.Genlmsg{
+		Command: cmd,
+		Version: unix.DEVLINK_GENL_VERSION,
+	})
+	req.AddData(nl.NewRtAttr(unix.DEVLINK_ATTR_BUS_NAME, nl.ZeroTerminated("pci")))
+	req.AddData(nl.NewRtAttr(unix.DEVLINK_ATTR_DEV_NAME, nl.ZeroTerminated(address)))
+	return req.Execute(unix.NETLINK_GENERIC, 0)
+}
+
+// Info returns the devlink dev info of a pci device
+func (c *devlinkClient) Info(address string) (*devlinkInfo, error) {
+	msgs, err := c.request(unix.DEVLINK_CMD_INFO_GET, 0, address)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, fmt.Errorf("no devlink info reply")
+	}
+	return parseDevlinkInfo(msgs[0])
+}
+
+// HealthReporters returns the health reporters of a pci device. Older kernels
+// ignore the device in a dump request, so the replies are filtered here.
+func (c *devlinkClient) HealthReporters(address string) ([]*devlinkHealthReporter, error) {
+	msgs, err := c.request(unix.DEVLINK_CMD_HEALTH_REPORTER_GET, unix.NLM_F_DUMP, address)
+	if err != nil {
+		return nil, err
+	}
+	return parseDevlinkHealthReporters(msgs, address)
+}
+
+// parseGenlAttrs parses the attributes of a generic netlink reply
+func parseGenlAttrs(msg []byte) ([]syscall.NetlinkRouteAttr, error) {
+	if len(msg) < nl.SizeofGenlmsg {
+		return nil, fmt.Errorf("short generic netlink message of %d bytes", len(msg))
+	}
+	return nl.ParseRouteAttr(msg[nl.SizeofGenlmsg:])
+}
+
+// parseDevlinkInfo parses a raw INFO_GET reply
+func parseDevlinkInfo(msg []byte) (*devlinkInfo, error) {
+	attrs, err := parseGenlAttrs(msg)
+	if err != nil {
+		return nil, err
+	}
+	info := &devlinkInfo{
+		Fixed:   make(map[string]string),
+		Running: make(map[string]string),
+		Stored:  make(map[string]string),
+	}
+	for _, a := range attrs {
+		var versions map[string]string
+		switch a.Attr.Type {
+		case unix.DEVLINK_ATTR_INFO_DRIVER_NAME:
+			info.Driver = nl.BytesToString(a.Value)
+		case unix.DEVLINK_ATTR_INFO_SERIAL_NUMBER:
+			info.Serial = nl.BytesToString(a.Value)
+		case unix.DEVLINK_ATTR_INFO_BOARD_SERIAL_NUMBER:
+			info.BoardSerial = nl.BytesToString(a.Value)
+		case unix.DEVLINK_ATTR_INFO_VERSION_FIXED:
+			versions = info.Fixed
+		case unix.DEVLINK_ATTR_INFO_VERSION_RUNNING:
+			versions = info.Running
+		case unix.DEVLINK_ATTR_INFO_VERSION_STORED:
+			versions = info.Stored
+		}
+		if versions == nil {
+			continue
+		}
+		nested, err := nl.ParseRouteAttr(a.Value)
+		if err != nil {
+			return nil, err
+		}
+		var name, value string
+		for _, n := range nested {
+			switch n.Attr.Type {
+			case unix.DEVLINK_ATTR_INFO_VERSION_NAME:
+				name = nl.BytesToString(n.Value)
+			case unix.DEVLINK_ATTR_INFO_VERSION_VALUE:
+				value = nl.BytesToString(n.Value)
+			}
+		}
+		if name != "" {
+			versions[name] = value
+		}
+	}
+	return info, nil
+}
+
+// parseDevlinkHealthReporters parses the raw HEALTH_REPORTER_GET replies,
+// keeping the reporters of the given pci device
+func parseDevlinkHealthReporters(msgs [][]byte, address string) ([]*devlinkHealthReporter, error) {
+	reporters := make([]*devlinkHealthReporter, 0)
+	native := nl.NativeEndian()
+	for _, msg := range msgs {
+		attrs, err := parseGenlAttrs(msg)
+		if err != nil {
+			return nil, err
+		}
+		var bus, dev string
+		var reporter *devlinkHealthReporter
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case unix.DEVLINK_ATTR_BUS_NAME:
+				bus = nl.BytesToString(a.Value)
+			case unix.DEVLINK_ATTR_DEV_NAME:
+				dev = nl.BytesToString(a.Value)
+			case unix.DEVLINK_ATTR_HEALTH_REPORTER:
+				nested, err := nl.ParseRouteAttr(a.Value)
+				if err != nil {
+					return nil, err
+				}
+				// the state is DEVLINK_HEALTH_REPORTER_STATE_HEALTHY (0) or
+				// DEVLINK_HEALTH_REPORTER_STATE_ERROR (1)
+				reporter = &devlinkHealthReporter{Healthy: true}
+				for _, n := range nested {
+					switch {
+					case n.Attr.Type == unix.DEVLINK_ATTR_HEALTH_REPORTER_NAME:
+						reporter.Name = nl.BytesToString(n.Value)
+					case n.Attr.Type == unix.DEVLINK_ATTR_HEALTH_REPORTER_STATE && len(n.Value) >= 1:
+						reporter.Healthy = n.Value[0] == 0
+					case n.Attr.Type == unix.DEVLINK_ATTR_HEALTH_REPORTER_ERR_COUNT && len(n.Value) >= 8:
+						reporter.ErrorCount = native.Uint64(n.Value)
+					case n.Attr.Type == unix.DEVLINK_ATTR_HEALTH_REPORTER_RECOVER_COUNT && len(n.Value) >= 8:
+						reporter.RecoverCount = native.Uint64(n.Value)
+					}
+				}
+			}
+		}
+		if bus == "pci" && dev == address && reporter != nil && reporter.Name != "" {
+			reporters = append(reporters, reporter)
+		}
+	}
+	return reporters, nil
+}
+
+// devlinkAttr returns the attribute name of a devlink version
+func devlinkAttr(name string) string {
+	return devlinkVersionPrefix + strings.NewReplacer(".", "_", "-", "_").Replace(name)
+}
+
+// attributes adds the serial numbers and the fixed and running versions of a
+// pf to the attributes of a device group. Running versions win over fixed
+// ones of the same name.
+func (info *devlinkInfo) attributes(attrs map[string]*structs.Attribute) {
+	if info == nil {
+		return
+	}
+	for _, versions := range []map[string]string{info.Fixed, info.Running} {
+		for name, value := range versions {
+			value := value
+			attrs[devlinkAttr(name)] = &structs.Attribute{String: &value}
+		}
+	}
+	if info.Serial != "" {
+		attrs[DevlinkSerialAttr] = &structs.Attribute{String: &info.Serial}
+	}
+	if info.BoardSerial != "" {
+		attrs[DevlinkBoardSerialAttr] = &structs.Attribute{String: &info.BoardSerial}
+	}
+}
+
+// devlinkMonitor polls the devlink info and health reporters of the pfs.
+// A reporter in error makes the vfs of its pf unhealthy, errors a reporter
+// recovered from since the previous fingerprint only describe them.
+type devlinkMonitor struct {
+	client *devlinkClient
+	// errors are the error counts of the previous fingerprint, by pf and
+	// reporter
+	errors map[string]map[string]uint64
+}
+
+func newDevlinkMonitor() *devlinkMonitor {
+	return &devlinkMonitor{errors: make(map[string]map[string]uint64)}
+}
+
+// devlinkState is the devlink info and health of the pfs during a
+// fingerprint
+type devlinkState struct {
+	info   map[string]*devlinkInfo
+	health map[string]*health
+}
+
+// checkDevlink queries devlink for every pf. Pfs whose driver does not
+// register with devlink are left out.
+func (d *VfDevicePlugin) checkDevlink(pfsMap map[string]*host.Pf) *devlinkState {
+	state := &devlinkState{
+		info:   make(map[string]*devlinkInfo),
+		health: make(map[string]*health),
+	}
+	m := d.devlinkMonitor
+	if m == nil {
+		return state
+	}
+	if m.client == nil {
+		client, err := newDevlinkClient()
+		if err != nil {
+			d.logger.Debug("devlink is not available", "error", err)
+			return state
+		}
+		m.client = client
+	}
+	counts := make(map[string]map[string]uint64)
+	for address := range pfsMap {
+		info, err := m.client.Info(address)
+		if err != nil {
+			d.logger.Trace("failed to get devlink info", "pf", address, "error", err)
+			continue
+		}
+		state.info[address] = info
+		reporters, err := m.client.HealthReporters(address)
+		if err != nil {
+			d.logger.Trace("failed to get devlink health reporters", "pf", address, "error", err)
+			continue
+		}
+		h := newHealth()
+		counts[address] = make(map[string]uint64)
+		for _, r := range reporters {
+			counts[address][r.Name] = r.ErrorCount
+			previous, seen := m.errors[address][r.Name]
+			switch {
+			case !r.Healthy:
+				h.fail(fmt.Sprintf("devlink reporter %s of %s in error, %d errors, %d recovered", r.Name, address, r.ErrorCount, r.RecoverCount))
+			case seen && r.ErrorCount > previous:
+				h.degrade(fmt.Sprintf("devlink reporter %s of %s recovered from %d errors", r.Name, address, r.ErrorCount-previous))
+			default:
+				continue
+			}
+			if !seen || r.ErrorCount != previous {
+				d.logger.Warn("devlink health reporter errors", "pf", address, "reporter", r.Name,
+					"healthy", r.Healthy, "errors", r.ErrorCount, "recovered", r.RecoverCount)
+			}
+		}
+		state.health[address] = h
+	}
+	m.errors = counts
+	return state
+}
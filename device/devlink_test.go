@@ -0,0 +1,117 @@
+package vf
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/plugins/shared/structs"
+)
+
+// readNetlinkFixture reads recorded generic netlink replies, one hex encoded
+// message per line without the netlink header, as returned by
+// NetlinkRequest.Execute. The fixtures are little endian.
+func readNetlinkFixture(t *testing.T, name string) [][]byte {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "devlink", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := make([][]byte, 0)
+	for _, line := range strings.Fields(string(data)) {
+		msg, err := hex.DecodeString(line)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func TestParseDevlinkInfo(t *testing.T) {
+	msgs := readNetlinkFixture(t, "info_get.hex")
+	info, err := parseDevlinkInfo(msgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &devlinkInfo{
+		Driver:      "mlx5_core",
+		BoardSerial: "MT2116X09299",
+		Fixed:       map[string]string{"fw.psid": "MT_0000000222"},
+		Running:     map[string]string{"fw.version": "22.31.1014", "fw": "22.31.1014"},
+		Stored:      map[string]string{"fw.version": "22.32.1010", "fw": "22.32.1010"},
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Errorf("expected %+v, got %+v", expected, info)
+	}
+}
+
+func TestParseDevlinkInfoShort(t *testing.T) {
+	if _, err := parseDevlinkInfo([]byte{51}); err == nil {
+		t.Error("expected an error for a short message")
+	}
+}
+
+func TestParseDevlinkHealthReporters(t *testing.T) {
+	// the dump holds the reporters of both pfs of the card
+	msgs := readNetlinkFixture(t, "health_reporter_get_dump.hex")
+	for _, tc := range []struct {
+		address  string
+		expected []*devlinkHealthReporter
+	}{
+		{
+			address: "0000:3b:00.0",
+			expected: []*devlinkHealthReporter{
+				{Name: "fw", Healthy: true},
+				{Name: "fw_fatal", Healthy: false, ErrorCount: 2, RecoverCount: 1},
+				{Name: "tx", Healthy: true, ErrorCount: 3, RecoverCount: 3},
+			},
+		},
+		{
+			address: "0000:3b:00.1",
+			expected: []*devlinkHealthReporter{
+				{Name: "fw_fatal", Healthy: false, ErrorCount: 5},
+				{Name: "tx", Healthy: true},
+			},
+		},
+		{
+			address:  "0000:af:00.0",
+			expected: []*devlinkHealthReporter{},
+		},
+	} {
+		reporters, err := parseDevlinkHealthReporters(msgs, tc.address)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.address, err)
+		}
+		if !reflect.DeepEqual(reporters, tc.expected) {
+			t.Errorf("%s: expected %+v, got %+v", tc.address, tc.expected, reporters)
+		}
+	}
+}
+
+func TestDevlinkInfoAttributes(t *testing.T) {
+	info := &devlinkInfo{
+		Serial: "b8599f0300d28cf0",
+		Fixed:  map[string]string{"fw.psid": "MT_0000000222", "serial_number": "bogus"},
+		// a version named like a built-in pf attribute does not replace it
+		Running: map[string]string{"fw.version": "22.31.1014", "driver": "bogus"},
+	}
+	driver := "mlx5_core"
+	attrs := map[string]*structs.Attribute{PfDriverAttr: {String: &driver}}
+	info.attributes(attrs)
+	for attr, expected := range map[string]string{
+		PfDriverAttr:               "mlx5_core",
+		DevlinkSerialAttr:          "b8599f0300d28cf0",
+		"pf_devlink_fw_psid":       "MT_0000000222",
+		"pf_devlink_fw_version":    "22.31.1014",
+		"pf_devlink_driver":        "bogus",
+		"pf_devlink_serial_number": "bogus",
+	} {
+		if value, ok := attrs[attr].GetString(); !ok || value != expected {
+			t.Errorf("%s: expected %q, got %v", attr, expected, attrs[attr])
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package vf
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/device"
+	"github.com/hashicorp/nomad/plugins/shared/structs"
+
+	"github.com/david-gurley/host"
+)
+
+const (
+	// ealArgsEnv holds the eal arguments allowing the reserved vfs, e.g.
+	// "-a 0000:3b:02.0 -a 0000:3b:02.1 --huge-dir /dev/hugepages"
+	ealArgsEnv = "VF_EAL_ARGS"
+	// pciAllowlistEnv holds the comma separated addresses of the reserved
+	// vfs
+	pciAllowlistEnv = "VF_PCI_ALLOWLIST"
+	// hugeDirEnv holds the first hugetlbfs mount
+	hugeDirEnv = "VF_HUGE_DIR"
+
+	// hugepagesAttrPrefix prefixes the free hugepages attributes, e.g.
+	// hugepages_2M_free
+	hugepagesAttrPrefix = "hugepages_"
+)
+
+var (
+	// mountsPath lists the mounts of the plugin, overridable for testing
+	mountsPath = "/proc/mounts"
+)
+
+// hugetlbfsMounts returns the mount points of hugetlbfs
+func hugetlbfsMounts() []string {
+	f, err := os.Open(mountsPath)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	mounts := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && fields[2] == "hugetlbfs" {
+			mounts = append(mounts, fields[1])
+		}
+	}
+	return mounts
+}
+
+// dpdkReservation returns what a dpdk application needs besides the vfio
+// group: the hugetlbfs mounts, the sysfs nodes of the vfs and the hugepages
+// read-only, the vfio container and group devices, and the eal arguments
+func dpdkReservation(vfs host.Vfs) ([]*device.Mount, []*device.DeviceSpec, map[string]string) {
+	mounts := make([]*device.Mount, 0)
+	specs := make([]*device.DeviceSpec, 0)
+	envs := make(map[string]string)
+	if len(vfs) == 0 {
+		return mounts, specs, envs
+	}
+
+	hugeDirs := hugetlbfsMounts()
+	for _, dir := range hugeDirs {
+		mounts = append(mounts, &device.Mount{TaskPath: dir, HostPath: dir})
+	}
+	hugepages := filepath.Join("/sys", "kernel", "mm", "hugepages")
+	mounts = append(mounts, &device.Mount{
+		TaskPath: hugepages,
+		HostPath: filepath.Join(sysfsRoot, "kernel", "mm", "hugepages"),
+		ReadOnly: true,
+	})
+
+	vfio := filepath.Join("/dev", "vfio", "vfio")
+	specs = append(specs, &device.DeviceSpec{TaskPath: vfio, HostPath: vfio, CgroupPerms: "rw"})
+	groups := make(map[string]bool)
+	addresses := make([]string, 0, len(vfs))
+	args := make([]string, 0, 2*len(vfs)+2)
+	for _, vf := range vfs {
+		mounts = append(mounts, &device.Mount{
+			TaskPath: filepath.Join("/sys", "bus", "pci", "devices", vf.Address),
+			HostPath: pciDevicePath(vf.Address),
+			ReadOnly: true,
+		})
+		if vf.IommuGroup != "" && !groups[vf.IommuGroup] {
+			groups[vf.IommuGroup] = true
+			group := filepath.Join("/dev", "vfio", vf.IommuGroup)
+			specs = append(specs, &device.DeviceSpec{TaskPath: group, HostPath: group, CgroupPerms: "rw"})
+		}
+		addresses = append(addresses, vf.Address)
+		args = append(args, "-a", vf.Address)
+	}
+	if len(hugeDirs) != 0 {
+		args = append(args, "--huge-dir", hugeDirs[0])
+		envs[hugeDirEnv] = hugeDirs[0]
+	}
+	envs[ealArgsEnv] = strings.Join(args, " ")
+	envs[pciAllowlistEnv] = strings.Join(addresses, ",")
+	return mounts, specs, envs
+}
+
+// hugepageSize formats a hugepages-<n>kB directory size, e.g. 2M or 1G
+func hugepageSize(kb int) string {
+	switch {
+	case kb%(1024*1024) == 0:
+		return fmt.Sprintf("%dG", kb/(1024*1024))
+	case kb%1024 == 0:
+		return fmt.Sprintf("%dM", kb/1024)
+	}
+	return fmt.Sprintf("%dK", kb)
+}
+
+// freeHugepages returns the free hugepages of a numa node by size, or of the
+// whole host for a negative node
+func freeHugepages(node int) map[string]int {
+	dir := filepath.Join(sysfsRoot, "kernel", "mm", "hugepages")
+	if node >= 0 {
+		dir = filepath.Join(sysfsRoot, "devices", "system", "node", fmt.Sprintf("node%d", node), "hugepages")
+	}
+	free := make(map[string]int)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return free
+	}
+	for _, e := range entries {
+		kb, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(e.Name(), "hugepages-"), "kB"))
+		if err != nil {
+			continue
+		}
+		n, err := host.ReadFileInt(filepath.Join(dir, e.Name(), "free_hugepages"))
+		if err != nil {
+			continue
+		}
+		free[hugepageSize(kb)] = n
+	}
+	return free
+}
+
+// hugepagesAttributes adds the free hugepages of the numa node of a device
+// group, e.g. hugepages_2M_free, or of the host when the vfs span nodes
+func hugepagesAttributes(vfs host.Vfs, attrs map[string]*structs.Attribute) {
+	node, _ := numaLocality(vfs)
+	for size, n := range freeHugepages(node) {
+		attrs[hugepagesAttrPrefix+size+"_free"] = structs.NewIntAttribute(int64(n), "")
+	}
+}
@@ -0,0 +1,60 @@
+package vf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestHugetlbfsMounts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mounts")
+	mounts := `sysfs /sys sysfs rw,nosuid,nodev,noexec,relatime 0 0
+hugetlbfs /dev/hugepages hugetlbfs rw,relatime,pagesize=2M 0 0
+tmpfs /run tmpfs rw,nosuid,nodev,mode=755 0 0
+nodev /mnt/huge-1G hugetlbfs rw,relatime,pagesize=1024M 0 0
+`
+	if err := ioutil.WriteFile(path, []byte(mounts), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(previous string) { mountsPath = previous }(mountsPath)
+	mountsPath = path
+
+	expected := []string{"/dev/hugepages", "/mnt/huge-1G"}
+	if got := hugetlbfsMounts(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestFreeHugepages(t *testing.T) {
+	root := t.TempDir()
+	for dir, free := range map[string]string{
+		filepath.Join(root, "kernel", "mm", "hugepages", "hugepages-2048kB"):                          "512\n",
+		filepath.Join(root, "kernel", "mm", "hugepages", "hugepages-1048576kB"):                       "4\n",
+		filepath.Join(root, "devices", "system", "node", "node1", "hugepages", "hugepages-2048kB"):    "256\n",
+		filepath.Join(root, "devices", "system", "node", "node1", "hugepages", "hugepages-1048576kB"): "2\n",
+	} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "free_hugepages"), []byte(free), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(previous string) { sysfsRoot = previous }(sysfsRoot)
+	sysfsRoot = root
+
+	for _, tc := range []struct {
+		node     int
+		expected map[string]int
+	}{
+		{-1, map[string]int{"2M": 512, "1G": 4}},
+		{1, map[string]int{"2M": 256, "1G": 2}},
+		{0, map[string]int{}},
+	} {
+		if got := freeHugepages(tc.node); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("node %d: expected %v, got %v", tc.node, tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package vf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/shared/hclspec"
+
+	"github.com/david-gurley/host"
+)
+
+const (
+	// ethernetClass is the only class host.GetVfs enumerates
+	ethernetClass = "0x020000"
+)
+
+// deviceClassSpec is the hcl spec of the device_class blocks
+func deviceClassSpec() *hclspec.Spec {
+	return hclspec.NewBlockList("device_class", hclspec.NewObject(map[string]*hclspec.Spec{
+		"class":  hclspec.NewAttr("class", "string", true),
+		"netdev": hclspec.NewAttr("netdev", "bool", false),
+	}))
+}
+
+// DeviceClassConfig is a device_class block, a pci class of vfs to advertise.
+// netdev enables the parts that need a kernel network interface: interface
+// name and mac address of the vfs, and ethtool stats and features of the pf.
+type DeviceClassConfig struct {
+	Class  string `codec:"class"`
+	Netdev bool   `codec:"netdev"`
+}
+
+type deviceClass struct {
+	pattern string
+	isGlob  bool
+	netdev  bool
+}
+
+// deviceClasses are the classes of vfs to enumerate. When empty, the ethernet
+// vfs are enumerated by the host package as before.
+type deviceClasses []*deviceClass
+
+func newDeviceClasses(configs []DeviceClassConfig) (deviceClasses, error) {
+	classes := make(deviceClasses, 0, len(configs))
+	for i, c := range configs {
+		pattern := strings.ToLower(c.Class)
+		isGlob := strings.ContainsAny(pattern, "*?[")
+		if err := validateGlob(pattern); err != nil {
+			return nil, fmt.Errorf("device_class %d: invalid class %q: %v", i, c.Class, err)
+		}
+		if !isGlob && !hexIDPattern.MatchString(pattern) {
+			return nil, fmt.Errorf("device_class %d: invalid class %q, must be a hex class", i, c.Class)
+		}
+		classes = append(classes, &deviceClass{
+			pattern: trimHexID(pattern),
+			isGlob:  isGlob,
+			netdev:  c.Netdev,
+		})
+	}
+	return classes, nil
+}
+
+// Match returns the class block matching a sysfs class such as 0x020700, or
+// nil
+func (cs deviceClasses) Match(class string) *deviceClass {
+	class = trimHexID(class)
+	for _, c := range cs {
+		if (c.isGlob && globMatch(c.pattern, class)) || c.pattern == class {
+			return c
+		}
+	}
+	return nil
+}
+
+// Netdev reports whether the netdev parts are enabled for a pci device
+func (cs deviceClasses) Netdev(address string) bool {
+	if len(cs) == 0 {
+		return true
+	}
+	class, err := host.GetPciDeviceClass(address)
+	if err != nil {
+		return false
+	}
+	c := cs.Match(class)
+	return c != nil && c.netdev
+}
+
+// getVfs enumerates the vfs of the configured classes. host.GetVfs only
+// returns ethernet vfs, so any other class is read from sysfs here.
+func (d *VfDevicePlugin) getVfs() (host.Vfs, error) {
+	if len(d.classes) == 0 {
+		return host.GetVfs()
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(sysfsRoot, "bus", "pci", "devices"))
+	if err != nil {
+		return nil, err
+	}
+	hostname, err := host.GetHostname()
+	if err != nil {
+		return nil, err
+	}
+	hostID, err := host.GetHostID()
+	if err != nil {
+		return nil, err
+	}
+	vfs := make(host.Vfs, 0)
+	for _, e := range entries {
+		address := e.Name()
+		class, err := host.GetPciDeviceClass(address)
+		if err != nil {
+			continue
+		}
+		c := d.classes.Match(class)
+		if c == nil || !isVf(address) {
+			continue
+		}
+		vf := readVf(address, c.netdev && class == ethernetClass)
+		vf.Hostname = hostname
+		vf.HostID = hostID
+		if c.netdev && vf.InterfaceName == "" {
+			vf.InterfaceName = netdevName(address)
+			vf.MacAddress = netdevMac(vf.InterfaceName)
+		}
+		vfs = append(vfs, vf)
+	}
+	if err := vfs.GetAllocations(); err != nil {
+		return nil, err
+	}
+	return vfs, nil
+}
+
+// getPfs enumerates the sr-iov capable pfs of the configured classes, or of
+// the ethernet class when none is configured. host.GetPfs only returns
+// ethernet pfs with a netdev, so the others are read from sysfs here.
+func (d *VfDevicePlugin) getPfs() (host.Pfs, error) {
+	pfsMap, err := host.GetPfsMap()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(sysfsRoot, "bus", "pci", "devices"))
+	if err != nil {
+		return nil, err
+	}
+	pfs := make(host.Pfs, 0)
+	for _, e := range entries {
+		address := e.Name()
+		if _, err := os.Stat(pciDevicePath(address, "sriov_totalvfs")); err != nil {
+			continue
+		}
+		class, err := host.GetPciDeviceClass(address)
+		if err != nil {
+			continue
+		}
+		if len(d.classes) == 0 && class != ethernetClass {
+			continue
+		}
+		if len(d.classes) != 0 && d.classes.Match(class) == nil {
+			continue
+		}
+		pf := pfsMap[address]
+		if pf == nil {
+			pf = readPf(address)
+		}
+		pfs = append(pfs, pf)
+	}
+	return pfs, nil
+}
+
+// readVf reads a vf from sysfs, ethernet vfs with netdev enabled are read by
+// the host package to also get their ip addresses
+func readVf(address string, ethernet bool) *host.Vf {
+	if ethernet {
+		if vf, err := host.GetVf(address); err == nil {
+			return &vf
+		}
+	}
+	vf := &host.Vf{
+		Address:    address,
+		IommuGroup: host.IommuGroup(address),
+		Driver:     host.Driver(address),
+		PfAddress:  physfn(address),
+	}
+	vf.VendorID, _ = host.GetPciDeviceVendor(address)
+	vf.DeviceID, _ = host.GetPciDeviceDevice(address)
+	// names are resolved from pci.ids later, the ids are the fallback
+	vf.Vendor = vf.VendorID
+	vf.Device = vf.DeviceID
+	return vf
+}
+
+// isVf reports whether a pci device is a virtual function
+func isVf(address string) bool {
+	_, err := os.Lstat(pciDevicePath(address, "physfn"))
+	return err == nil
+}
+
+// physfn returns the address of the pf of a vf
+func physfn(address string) string {
+	target, err := os.Readlink(pciDevicePath(address, "physfn"))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(target)
+}
+
+// netdevName returns the kernel network interface of a pci device, e.g. the
+// ipoib interface of an infiniband vf, or an empty string
+func netdevName(address string) string {
+	entries, err := ioutil.ReadDir(pciDevicePath(address, "net"))
+	if err != nil || len(entries) == 0 {
+		return ""
+	}
+	return entries[0].Name()
+}
+
+// netdevMac returns the hardware address of an interface
+func netdevMac(interfaceName string) string {
+	if interfaceName == "" {
+		return ""
+	}
+	mac, err := host.ReadFileString(filepath.Join(sysfsRoot, "class", "net", interfaceName, "address"))
+	if err != nil {
+		return ""
+	}
+	return mac
+}
+
+// addMissingPfs adds the pfs of vfs that host.GetPfsMap does not know, the
+// pfs without an ethernet netdev, read from sysfs
+func addMissingPfs(vfs host.Vfs, pfsMap map[string]*host.Pf) {
+	for _, vf := range vfs {
+		if vf.PfAddress == "" || pfsMap[vf.PfAddress] != nil {
+			continue
+		}
+		pfsMap[vf.PfAddress] = readPf(vf.PfAddress)
+	}
+}
+
+// readPf reads the pci identity of a pf from sysfs
+func readPf(address string) *host.Pf {
+	pf := &host.Pf{
+		Address:       address,
+		Driver:        host.Driver(address),
+		InterfaceName: netdevName(address),
+	}
+	pf.VendorID, _ = host.GetPciDeviceVendor(address)
+	pf.DeviceID, _ = host.GetPciDeviceDevice(address)
+	pf.Vendor = pf.VendorID
+	pf.Device = pf.DeviceID
+	pf.MacAddress = netdevMac(pf.InterfaceName)
+	pf.TotalVfs, _ = host.ReadFileInt(pciDevicePath(address, "sriov_totalvfs"))
+	pf.NumVfs, _ = host.ReadFileInt(pciDevicePath(address, "sriov_numvfs"))
+	return pf
+}
@@ -0,0 +1,72 @@
+package vf
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/shared/structs"
+
+	"github.com/david-gurley/host"
+)
+
+const (
+	// featureAttrPrefix prefixes the ethtool feature attributes, e.g.
+	// hw-tc-offload is exposed as feature_hw_tc_offload
+	featureAttrPrefix = "feature_"
+)
+
+// featureAttr returns the attribute name of an ethtool feature
+func featureAttr(feature string) string {
+	return featureAttrPrefix + strings.NewReplacer("-", "_", ".", "_").Replace(feature)
+}
+
+// validateFeatures checks the pf_features allowlist
+func validateFeatures(features []string) error {
+	seen := make(map[string]bool)
+	for _, f := range features {
+		if strings.TrimSpace(f) == "" || strings.ContainsAny(f, " \t") {
+			return fmt.Errorf("invalid pf_features entry %q", f)
+		}
+		if seen[featureAttr(f)] {
+			return fmt.Errorf("duplicate pf_features entry %q", f)
+		}
+		seen[featureAttr(f)] = true
+	}
+	return nil
+}
+
+// pfFeatures returns the allowlisted ethtool features of every pf of a class
+// with netdev enabled. Features the driver does not report are left out.
+func (d *VfDevicePlugin) pfFeatures(pfsMap map[string]*host.Pf) map[string]map[string]bool {
+	features := make(map[string]map[string]bool)
+	if len(d.features) == 0 {
+		return features
+	}
+	for address, pf := range pfsMap {
+		if pf.InterfaceName == "" || !d.classes.Netdev(address) {
+			continue
+		}
+		all, err := pf.Features()
+		if err != nil {
+			d.logger.Debug("failed to get pf features", "pf", address, "error", err)
+			continue
+		}
+		allowed := make(map[string]bool, len(d.features))
+		for _, f := range d.features {
+			if enabled, ok := all[f]; ok {
+				allowed[f] = enabled
+			}
+		}
+		features[address] = allowed
+	}
+	return features
+}
+
+// featureAttributes adds the features of a pf to the attributes of a device
+// group
+func featureAttributes(features map[string]bool, attrs map[string]*structs.Attribute) {
+	for f, enabled := range features {
+		enabled := enabled
+		attrs[featureAttr(f)] = &structs.Attribute{Bool: &enabled}
+	}
+}
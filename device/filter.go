@@ -0,0 +1,187 @@
+package vf
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/shared/hclspec"
+
+	"github.com/david-gurley/host"
+)
+
+var (
+	hexIDPattern   = regexp.MustCompile(`^(0x)?[0-9a-f]{1,6}$`)
+	iommuGroupDigs = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// deviceSelectorSpec is the hcl spec of the include and exclude blocks
+func deviceSelectorSpec(name string) *hclspec.Spec {
+	return hclspec.NewBlockList(name, hclspec.NewObject(map[string]*hclspec.Spec{
+		"vendor_id":    hclspec.NewAttr("vendor_id", "string", false),
+		"device_id":    hclspec.NewAttr("device_id", "string", false),
+		"class":        hclspec.NewAttr("class", "string", false),
+		"driver":       hclspec.NewAttr("driver", "string", false),
+		"pf_address":   hclspec.NewAttr("pf_address", "string", false),
+		"pf_interface": hclspec.NewAttr("pf_interface", "string", false),
+		"iommu_group":  hclspec.NewAttr("iommu_group", "string", false),
+	}))
+}
+
+// DeviceSelectorConfig is an include or exclude block. Every field that is
+// set has to match. A value containing *, ? or [ is matched as a glob,
+// anything else has to match exactly. Ids are hex, with or without 0x.
+type DeviceSelectorConfig struct {
+	VendorID    string `codec:"vendor_id"`
+	DeviceID    string `codec:"device_id"`
+	Class       string `codec:"class"`
+	Driver      string `codec:"driver"`
+	PfAddress   string `codec:"pf_address"`
+	PfInterface string `codec:"pf_interface"`
+	IommuGroup  string `codec:"iommu_group"`
+}
+
+// selectedDevice is what a device selector is matched against
+type selectedDevice struct {
+	vf    *host.Vf
+	pf    *host.Pf
+	class string
+}
+
+type deviceCriterion func(d *selectedDevice) bool
+
+type deviceSelector []deviceCriterion
+
+// deviceSelectors matches a device when any of the selectors matches
+type deviceSelectors []deviceSelector
+
+func newDeviceSelectors(block string, configs []DeviceSelectorConfig) (deviceSelectors, error) {
+	selectors := make(deviceSelectors, 0, len(configs))
+	for i, c := range configs {
+		s, err := newDeviceSelector(c)
+		if err != nil {
+			return nil, fmt.Errorf("%s %d: %v", block, i, err)
+		}
+		selectors = append(selectors, s)
+	}
+	return selectors, nil
+}
+
+func newDeviceSelector(c DeviceSelectorConfig) (deviceSelector, error) {
+	s := make(deviceSelector, 0)
+	add := func(field string, pattern string, hexID bool, value func(d *selectedDevice) string) error {
+		if pattern == "" {
+			return nil
+		}
+		pattern = strings.ToLower(pattern)
+		if err := validateGlob(pattern); err != nil {
+			return fmt.Errorf("invalid %s %q: %v", field, pattern, err)
+		}
+		isGlob := strings.ContainsAny(pattern, "*?[")
+		if hexID {
+			if !isGlob && !hexIDPattern.MatchString(pattern) {
+				return fmt.Errorf("invalid %s %q, must be a hex id", field, pattern)
+			}
+			pattern = trimHexID(pattern)
+		}
+		s = append(s, func(d *selectedDevice) bool {
+			v := strings.ToLower(value(d))
+			if hexID {
+				v = trimHexID(v)
+			}
+			if isGlob {
+				return globMatch(pattern, v)
+			}
+			return v == pattern
+		})
+		return nil
+	}
+	if c.IommuGroup != "" && !strings.ContainsAny(c.IommuGroup, "*?[") && !iommuGroupDigs.MatchString(c.IommuGroup) {
+		return nil, fmt.Errorf("invalid iommu_group %q, must be a number", c.IommuGroup)
+	}
+	for _, err := range []error{
+		add("vendor_id", c.VendorID, true, func(d *selectedDevice) string { return d.vf.VendorID }),
+		add("device_id", c.DeviceID, true, func(d *selectedDevice) string { return d.vf.DeviceID }),
+		add("class", c.Class, true, func(d *selectedDevice) string { return d.class }),
+		add("driver", c.Driver, false, func(d *selectedDevice) string { return d.vf.Driver }),
+		add("pf_address", c.PfAddress, false, func(d *selectedDevice) string { return d.vf.PfAddress }),
+		add("pf_interface", c.PfInterface, false, func(d *selectedDevice) string {
+			if d.pf == nil {
+				return ""
+			}
+			return d.pf.InterfaceName
+		}),
+		add("iommu_group", c.IommuGroup, false, func(d *selectedDevice) string { return d.vf.IommuGroup }),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(s) == 0 {
+		return nil, fmt.Errorf("at least one selection criterion is required")
+	}
+	return s, nil
+}
+
+// Matches reports whether every criterion of the selector matches
+func (s deviceSelector) Matches(d *selectedDevice) bool {
+	for _, criterion := range s {
+		if !criterion(d) {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches reports whether any of the selectors matches
+func (selectors deviceSelectors) Matches(d *selectedDevice) bool {
+	for _, s := range selectors {
+		if s.Matches(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceFilter decides which vfs are advertised. When include blocks are
+// configured they replace the legacy vendors regexp list.
+type deviceFilter struct {
+	vendors  []string
+	include  deviceSelectors
+	exclude  deviceSelectors
+	pfFilter pfSelectors
+}
+
+// pfAddresses returns the set of pfs of vfs
+func pfAddresses(vfs host.Vfs) map[string]bool {
+	addresses := make(map[string]bool)
+	for _, vf := range vfs {
+		addresses[vf.PfAddress] = true
+	}
+	return addresses
+}
+
+// Filter returns the vfs that should be advertised
+func (f *deviceFilter) Filter(vfs host.Vfs, pfsMap map[string]*host.Pf) host.Vfs {
+	candidates := vfs
+	if len(f.include) == 0 {
+		candidates = vfs.ByVendors(f.vendors)
+	}
+	filtered := make(host.Vfs, 0)
+	for _, vf := range candidates {
+		pf := pfsMap[vf.PfAddress]
+		if !f.pfFilter.Matches(pf) {
+			continue
+		}
+		class, _ := host.GetPciDeviceClass(vf.Address)
+		d := &selectedDevice{vf: vf, pf: pf, class: class}
+		if len(f.include) != 0 && !f.include.Matches(d) {
+			continue
+		}
+		if f.exclude.Matches(d) {
+			continue
+		}
+		filtered = append(filtered, vf)
+	}
+	return filtered
+}
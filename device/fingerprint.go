@@ -15,12 +15,25 @@ const (
 	PfDriverAttr          = "pf_driver"
 	PfDriverVersionAttr   = "pf_driver_version"
 	PfFirmwareVersionAttr = "pf_firmware_version"
+
+	// attributes for device groups (vf-level)
+	VendorNameAttr = "vendor_name"
+	VendorIDAttr   = "vendor_id"
+	DeviceNameAttr = "device_name"
+	DeviceIDAttr   = "device_id"
 )
 
 // doFingerprint is the long-running goroutine that detects device changes
 func (d *VfDevicePlugin) doFingerprint(ctx context.Context, devices chan *device.FingerprintResponse) {
 	defer close(devices)
 
+	// provision the pfs before the first fingerprint so it reflects the
+	// result. Pfs with vfs in use never block it, a "wait" resize is retried
+	// on the next fingerprints.
+	d.applySriovPolicies(ctx)
+	d.applyPools()
+	d.applyPfDevices()
+
 	// Create a timer that will fire immediately for the first detection
 	ticker := time.NewTimer(0)
 
@@ -32,24 +45,22 @@ func (d *VfDevicePlugin) doFingerprint(ctx context.Context, devices chan *device
 			ticker.Reset(d.fingerprintPeriod)
 		}
 
+		// bind the pool vfs of the pfs resized since the last fingerprint
+		if d.retryDeferredPfConfigs(ctx) {
+			d.applyPools()
+		}
+
 		d.writeFingerprintToChannel(devices)
 	}
 }
 
-// build fingerprint/stats response with computed groups
-// {{ vendor }}/{{ device_type }}/{{ pf_address }}
-// e.g. pensando/vf/0000.0000.0000
-type GroupMapping struct {
-	Devices host.Vfs
-	Vendor  string
-	Type    string
-}
-
 // writeFingerprintToChannel collects fingerprint info, partitions devices into
 // device groups, and sends the data over the provided channel.
 func (d *VfDevicePlugin) writeFingerprintToChannel(devices chan<- *device.FingerprintResponse) {
 
-	fingerprintData, err := host.GetVfs()
+	preflight := d.runPreflight()
+
+	fingerprintData, err := d.getVfs()
 	if err != nil {
 		d.logger.Error("failed to get fingerprint pci vf devices", "error", err)
 		devices <- device.NewFingerprintError(err)
@@ -62,60 +73,244 @@ func (d *VfDevicePlugin) writeFingerprintToChannel(devices chan<- *device.Finger
 		return
 	}
 
+	addMissingPfs(fingerprintData, pfsMap)
+	d.markNetdeviceAllocations(fingerprintData, pfsMap)
+	for _, vf := range fingerprintData {
+		d.pciNames.resolveVf(vf)
+	}
+	for _, pf := range pfsMap {
+		d.pciNames.resolvePf(pf)
+	}
+
+	allocations, err := host.VfioAllocations()
+	if err != nil {
+		d.logger.Error("failed to get vfio allocations", "error", err)
+		devices <- device.NewFingerprintError(err)
+		return
+	}
+	d.pruneReservations(allocations)
+	d.pinReservedIrqs()
+
+	pfDevices, pfDeviceBlocks, err := d.fingerprintPfDevices(allocations)
+	if err != nil {
+		d.logger.Error("failed to get pf devices", "error", err)
+	}
+	addMissingPfs(pfDevices, pfsMap)
+	availablePfs := make(host.Vfs, 0, len(pfDevices))
+	for _, pf := range pfDevices {
+		d.pciNames.resolveVf(pf)
+		d.pciNames.resolvePf(pfsMap[pf.Address])
+		if !pf.Allocated {
+			availablePfs = append(availablePfs, pf)
+		}
+	}
+
 	// only show devices we care about (from configuration)
-	fingerprintDevices := filterFingerprintedDevices(fingerprintData, d.vendors)
+	fingerprintDevices := d.filter.Filter(fingerprintData, pfsMap)
 
-	deviceGroupNames := make(map[string]GroupMapping)
-	devicesMap := make(map[string]*host.Vf)
+	available := make(host.Vfs, 0, len(fingerprintDevices))
 	for _, vf := range fingerprintDevices {
 		if vf.Allocated {
 			continue
 		}
-		devicesMap[vf.Address] = vf
-		deviceGroupNames[vf.PfAddress] = GroupMapping{
-			Devices: append(deviceGroupNames[vf.PfAddress].Devices, vf),
-			Vendor:  vf.Vendor,
-			Type:    "vf",
+		available = append(available, vf)
+	}
+	links := readPcieLinks(pfsMap)
+	for address, link := range links {
+		if link.Degraded() {
+			d.logger.Warn("pf pcie link degraded", "pf", address, "link", link.HealthDesc())
 		}
 	}
-	d.devices = devicesMap
-	numDeviceGroups := 0
-	for _, _ = range deviceGroupNames {
-		numDeviceGroups++
+	all, guarded := d.applyGuard(append(available, availablePfs...), pfsMap)
+	available, availablePfs = host.Vfs{}, host.Vfs{}
+	for _, vf := range all {
+		if vf.Address == vf.PfAddress {
+			availablePfs = append(availablePfs, vf)
+		} else {
+			available = append(available, vf)
+		}
+	}
+	devlink := d.checkDevlink(pfsMap)
+	deviceHealth := &fingerprintHealth{
+		links:     links,
+		guarded:   guarded,
+		aer:       d.checkAer(all),
+		iommu:     checkIommuViable(availablePfs),
+		devlink:   devlink.health,
+		preflight: preflight.Desc(),
+	}
+	features := d.pfFeatures(pfsMap)
+	modes := d.eswitchModes(pfsMap)
+	representors := vfRepresentors(pfsMap, modes)
+	ptp := readPtpInfos(pfsMap)
+	ports := pfPorts(pfsMap)
+	// ids are computed over every enumerated device, allocated ones included,
+	// so an id does not change when the device sharing it is allocated
+	enumerated := make(host.Vfs, 0, len(fingerprintData)+len(pfDevices))
+	enumerated = append(append(enumerated, fingerprintData...), pfDevices...)
+	ids := deviceIDs(enumerated, ports)
+	deviceGroupNames := d.groupDevices(available, pfsMap, pfAddresses(fingerprintDevices), ports, ids)
+	groupPfDevices(availablePfs, pfDeviceBlocks, deviceGroupNames)
+	devicesMap := make(map[string]host.Vfs)
+	vfPools := make(map[string]*pool)
+	for _, groupMapping := range deviceGroupNames {
+		for _, instance := range groupMapping.Instances(ids) {
+			devicesMap[instance.ID] = instance.Devices
+		}
+		if p := groupMapping.Pool; p != nil {
+			for _, vf := range groupMapping.Devices {
+				vfPools[vf.Address] = p
+			}
+		}
 	}
-	deviceGroups := make([]*device.DeviceGroup, 0, numDeviceGroups)
-	for groupName, groupMapping := range deviceGroupNames {
+	d.deviceLock.Lock()
+	d.devices = devicesMap
+	d.groups = deviceGroupNames
+	d.ids = ids
+	d.representors = representors
+	d.ptp = ptp
+	d.vfPools = vfPools
+	d.pfs = pfsMap
+	d.deviceLock.Unlock()
+	deviceGroups := make([]*device.DeviceGroup, 0, len(deviceGroupNames))
+	for _, groupMapping := range deviceGroupNames {
 		devices := make([]*device.Device, 0)
-		for _, vf := range groupMapping.Devices {
+		for _, instance := range groupMapping.Instances(ids) {
+			h := deviceHealth.instanceHealth(instance, groupMapping.Vfio())
 			devices = append(devices, &device.Device{
-				ID:      vf.Address,
-				Healthy: true,
+				ID:         instance.ID,
+				Healthy:    h.healthy,
+				HealthDesc: h.Desc(),
 				HwLocality: &device.DeviceLocality{
-					PciBusID: vf.Address,
+					PciBusID: instance.Devices[0].Address,
 				},
 			})
 		}
+		pfAttrs := make([]map[string]*structs.Attribute, 0)
+		for _, pfAddress := range groupPfAddresses(groupMapping.Devices) {
+			attrs := pfAttributes(pfsMap[pfAddress], links[pfAddress])
+			featureAttributes(features[pfAddress], attrs)
+			devlink.info[pfAddress].attributes(attrs)
+			ptp[pfAddress].attributes(attrs)
+			pfAttrs = append(pfAttrs, attrs)
+		}
+		attrs := attributesFromFingerprintDeviceData(groupMapping, d.pciNames,
+			d.pfLabels.commonLabels(groupMapping.Devices, pfsMap), commonAttributes(pfAttrs), preflight.attrs)
+		portAttributes(groupMapping.Devices, ports, attrs)
+		eswitchAttributes(groupMapping.Devices, modes, representors, attrs)
+		rdmaAttributes(groupMapping.Devices, attrs)
+		stable := hasStableIDs(groupMapping.Devices, ids)
+		attrs[StableIDsAttr] = &structs.Attribute{Bool: &stable}
+		if groupMapping.Bundles != nil {
+			attrs[BundleDistinctCardsAttr] = &structs.Attribute{Bool: &d.bundler.distinctCards}
+		}
 		deviceGroups = append(deviceGroups, &device.DeviceGroup{
 			Vendor:     groupMapping.Vendor,
 			Type:       groupMapping.Type,
-			Name:       groupName,
+			Name:       groupMapping.Name,
 			Devices:    devices,
-			Attributes: attributesFromFingerprintDeviceData(groupMapping.Devices, pfsMap[groupMapping.Devices[0].PfAddress]),
+			Attributes: attrs,
 		})
 	}
 	devices <- device.NewFingerprint(deviceGroups...)
 }
 
-// ignoreFingerprintedDevices excludes ignored devices from fingerprint output
-func filterFingerprintedDevices(deviceData host.Vfs, vendors []string) host.Vfs {
-	return deviceData.ByVendors(vendors)
+// groupPfAddresses returns the distinct pfs of the vfs of a group, in order
+func groupPfAddresses(vfs host.Vfs) []string {
+	seen := make(map[string]bool)
+	addresses := make([]string, 0)
+	for _, vf := range vfs {
+		if !seen[vf.PfAddress] {
+			seen[vf.PfAddress] = true
+			addresses = append(addresses, vf.PfAddress)
+		}
+	}
+	return addresses
+}
+
+// pfAttributes returns the driver, firmware and pcie link attributes of a pf
+func pfAttributes(pf *host.Pf, link *pcieLink) map[string]*structs.Attribute {
+	attrs := map[string]*structs.Attribute{}
+	if pf != nil {
+		attrs[PfFirmwareVersionAttr] = &structs.Attribute{String: &pf.FwVersion}
+		attrs[PfDriverAttr] = &structs.Attribute{String: &pf.Driver}
+		attrs[PfDriverVersionAttr] = &structs.Attribute{String: &pf.DriverVersion}
+	}
+	link.attributes(attrs)
+	return attrs
+}
+
+// commonAttributes returns the attributes every set has with the same value,
+// so a group spanning several pfs only gets the pf attributes they agree on
+func commonAttributes(sets []map[string]*structs.Attribute) map[string]*structs.Attribute {
+	common := map[string]*structs.Attribute{}
+	if len(sets) == 0 {
+		return common
+	}
+	for k, v := range sets[0] {
+		agree := true
+		for _, set := range sets[1:] {
+			other, ok := set[k]
+			if !ok {
+				agree = false
+				break
+			}
+			if c, ok := v.Compare(other); !ok || c != 0 {
+				agree = false
+				break
+			}
+		}
+		if agree {
+			common[k] = v
+		}
+	}
+	return common
 }
 
-// attributes for a slice of vfs associated to a single pf
-func attributesFromFingerprintDeviceData(d host.Vfs, pf *host.Pf) map[string]*structs.Attribute {
+// attributes for a device group, pfAttrs are the pf attributes shared by the
+// pfs of the group
+func attributesFromFingerprintDeviceData(group *GroupMapping, names *pciNames, labels map[string]string, pfAttrs map[string]*structs.Attribute, hostAttrs map[string]*structs.Attribute) map[string]*structs.Attribute {
 	attrs := map[string]*structs.Attribute{}
-	attrs[PfFirmwareVersionAttr] = &structs.Attribute{String: &pf.FwVersion}
-	attrs[PfDriverAttr] = &structs.Attribute{String: &pf.Driver}
-	attrs[PfDriverVersionAttr] = &structs.Attribute{String: &pf.DriverVersion}
+	// operator labels never override the attributes below
+	for k, v := range labels {
+		v := v
+		attrs[k] = &structs.Attribute{String: &v}
+	}
+	for k, v := range hostAttrs {
+		attrs[k] = v
+	}
+	d := group.Devices
+	vendorName := names.VendorName(d[0].VendorID)
+	if vendorName == "" {
+		vendorName = d[0].Vendor
+	}
+	attrs[VendorNameAttr] = &structs.Attribute{String: &vendorName}
+	attrs[VendorIDAttr] = &structs.Attribute{String: &d[0].VendorID}
+	attrs[DeviceNameAttr] = &structs.Attribute{String: &d[0].Device}
+	attrs[DeviceIDAttr] = &structs.Attribute{String: &d[0].DeviceID}
+	for k, v := range pfAttrs {
+		attrs[k] = v
+	}
+	node, cpus := numaLocality(d)
+	if node >= 0 {
+		attrs[NumaNodeAttr] = structs.NewIntAttribute(int64(node), "")
+	}
+	if cpus != "" {
+		attrs[LocalCpulistAttr] = &structs.Attribute{String: &cpus}
+	}
+	if p := group.Pool; p != nil {
+		attrs[PoolAttr] = &structs.Attribute{String: &p.Name}
+		if p.Profile != "" {
+			attrs[ProfileAttr] = &structs.Attribute{String: &p.Profile}
+		}
+		attrs[PoolModeAttr] = &structs.Attribute{String: &p.Mode}
+		if p.Mode == poolModeDpdk {
+			hugepagesAttributes(d, attrs)
+		}
+		for k, v := range p.Attributes {
+			v := v
+			attrs[k] = &structs.Attribute{String: &v}
+		}
+	}
 	return attrs
 }
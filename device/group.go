@@ -0,0 +1,260 @@
+package vf
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/david-gurley/host"
+)
+
+const (
+	groupingPf    = "pf"
+	groupingModel = "model"
+	groupingNuma  = "numa"
+	groupingPool  = "pool"
+	groupingLabel = "label"
+
+	// defaultPoolName is the pool of vfs not claimed by any pool block
+	defaultPoolName = "default"
+)
+
+var (
+	groupingNames = map[string]string{
+		groupingPf:    "{{ .PfAddress }}",
+		groupingModel: "{{ slug .Device }}",
+		groupingNuma:  "numa{{ .NumaNode }}",
+		groupingPool:  "{{ .Pool }}",
+	}
+
+	groupTemplateFuncs = template.FuncMap{
+		"slug":  slug,
+		"lower": strings.ToLower,
+		"upper": strings.ToUpper,
+	}
+)
+
+// build fingerprint/stats response with computed groups
+// {{ vendor }}/{{ device_type }}/{{ name }}, where the name depends on the
+// grouping strategy, e.g. pensando/vf/0000.0000.0000 when grouping by pf
+//
+// vfs claimed by a pool are grouped as {{ pool vendor }}/{{ pool type }}/{{ pool device_name }}
+// e.g. generic/dpdk/dpdk
+//
+// bundled vfs are grouped as generic/bundle/{{ bundle name }}, with one device
+// per bundle
+type GroupMapping struct {
+	Devices host.Vfs
+	Vendor  string
+	Type    string
+	Name    string
+	Pool    *pool
+	Bundles []*deviceInstance
+}
+
+// deviceInstance is a nomad device and the vfs it stands for, a single vf or
+// a bundle of vfs
+type deviceInstance struct {
+	ID      string
+	Devices host.Vfs
+}
+
+// Instances returns the nomad devices of the group, ids maps vf addresses to
+// device ids
+func (g *GroupMapping) Instances(ids map[string]string) []*deviceInstance {
+	if g.Bundles != nil {
+		return g.Bundles
+	}
+	instances := make([]*deviceInstance, 0, len(g.Devices))
+	for _, vf := range g.Devices {
+		instances = append(instances, &deviceInstance{ID: deviceID(vf, ids), Devices: host.Vfs{vf}})
+	}
+	return instances
+}
+
+// Key is the unique vendor/type/name of the group
+func (g *GroupMapping) Key() string {
+	return g.Vendor + "/" + g.Type + "/" + g.Name
+}
+
+// Vfio reports whether the devices of the group are handed out through vfio:
+// pf devices, vfs outside pools and vfs of vfio and dpdk pools
+func (g *GroupMapping) Vfio() bool {
+	return g.Pool == nil || g.Pool.Mode != poolModeNetdevice
+}
+
+// groupData is what the group vendor, type and name templates are rendered
+// with
+type groupData struct {
+	Vendor      string
+	VendorID    string
+	Device      string
+	DeviceID    string
+	PfAddress   string
+	PfInterface string
+	NumaNode    int
+	Pool        string
+	Labels      map[string]string
+}
+
+// grouping renders the device group identity of a vf. Every grouping
+// strategy is a default name template; vfs rendering to the same
+// vendor/type/name end up in the same group.
+type grouping struct {
+	vendor *template.Template
+	typ    *template.Template
+	name   *template.Template
+}
+
+// newGrouping validates the grouping strategy and the templates overriding
+// its defaults
+func newGrouping(strategy string, label string, vendorTmpl string, typeTmpl string, nameTmpl string) (*grouping, error) {
+	defaultName, ok := groupingNames[strategy]
+	switch {
+	case strategy == groupingLabel:
+		if label == "" {
+			return nil, fmt.Errorf("grouping %q requires group_label", groupingLabel)
+		}
+		defaultName = fmt.Sprintf("{{ index .Labels %q }}", label)
+	case !ok:
+		return nil, fmt.Errorf("invalid grouping %q, must be one of pf, model, numa, pool or label", strategy)
+	}
+	if vendorTmpl == "" {
+		vendorTmpl = "{{ .Vendor }}"
+	}
+	if typeTmpl == "" {
+		typeTmpl = deviceType
+	}
+	if nameTmpl == "" {
+		nameTmpl = defaultName
+	}
+	var g grouping
+	for _, t := range []struct {
+		field string
+		text  string
+		out   **template.Template
+	}{
+		{"group_vendor", vendorTmpl, &g.vendor},
+		{"group_type", typeTmpl, &g.typ},
+		{"group_name", nameTmpl, &g.name},
+	} {
+		parsed, err := template.New(t.field).Funcs(groupTemplateFuncs).Option("missingkey=zero").Parse(t.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", t.field, t.text, err)
+		}
+		*t.out = parsed
+	}
+	return &g, nil
+}
+
+// Render returns the vendor, type and name of the group of a vf. Empty
+// values fall back to the vf vendor, the default type and the pf address.
+func (g *grouping) Render(data *groupData) (string, string, string, error) {
+	values := make([]string, 3)
+	for i, t := range []*template.Template{g.vendor, g.typ, g.name} {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			return "", "", "", err
+		}
+		values[i] = strings.TrimSpace(buf.String())
+	}
+	if values[0] == "" {
+		values[0] = data.Vendor
+	}
+	if values[1] == "" {
+		values[1] = deviceType
+	}
+	if values[2] == "" {
+		values[2] = data.PfAddress
+	}
+	return values[0], values[1], values[2], nil
+}
+
+// groupDevices partitions vfs into device groups keyed by vendor/type/name.
+// filtered are the pfs with vfs passing the device filter, allocated or not.
+func (d *VfDevicePlugin) groupDevices(vfs host.Vfs, pfsMap map[string]*host.Pf, filtered map[string]bool, ports map[string]*port, ids map[string]string) map[string]*GroupMapping {
+	indexes := make(map[string]map[string]int)
+	groups := make(map[string]*GroupMapping)
+	candidates := make([]*bundleCandidate, 0)
+	for _, vf := range vfs {
+		if indexes[vf.PfAddress] == nil {
+			indexes[vf.PfAddress] = vfIndexes(vf.PfAddress)
+		}
+		index, ok := indexes[vf.PfAddress][vf.Address]
+		if !ok {
+			index = -1
+		}
+		pf := pfsMap[vf.PfAddress]
+		if d.bundler.Claims(pf, index) {
+			candidates = append(candidates, &bundleCandidate{vf, index})
+			continue
+		}
+		var group *GroupMapping
+		if p := d.pools.Assign(pf, index); p != nil {
+			group = &GroupMapping{
+				Vendor: p.Vendor,
+				Type:   p.Type,
+				Name:   p.DeviceName,
+				Pool:   p,
+			}
+		} else {
+			data := &groupData{
+				Vendor:    vf.Vendor,
+				VendorID:  vf.VendorID,
+				Device:    vf.Device,
+				DeviceID:  vf.DeviceID,
+				PfAddress: vf.PfAddress,
+				NumaNode:  numaNode(vf.Address),
+				Pool:      defaultPoolName,
+				Labels:    d.pfLabels.For(pf),
+			}
+			if pf != nil {
+				data.PfInterface = pf.InterfaceName
+			}
+			vendor, typ, name, err := d.grouping.Render(data)
+			if err != nil {
+				d.logger.Error("failed to render device group, grouping by pf", "vf", vf.Address, "error", err)
+				vendor, typ, name = vf.Vendor, deviceType, vf.PfAddress
+			}
+			group = &GroupMapping{
+				Vendor: vendor,
+				Type:   typ,
+				Name:   name,
+			}
+		}
+		if existing, ok := groups[group.Key()]; ok {
+			group = existing
+		} else {
+			groups[group.Key()] = group
+		}
+		group.Devices = append(group.Devices, vf)
+	}
+	if d.splitNuma {
+		groups = splitNuma(groups)
+	}
+	if len(candidates) != 0 {
+		if bundles := d.bundler.Pair(candidates, pfsMap, filtered, ports, ids); len(bundles) != 0 {
+			group := d.bundler.Group(bundles)
+			groups[group.Key()] = group
+		}
+	}
+	for _, group := range groups {
+		sortVfs(group.Devices)
+	}
+	return groups
+}
+
+// sortVfs orders vfs by address
+func sortVfs(vfs host.Vfs) {
+	sort.Slice(vfs, func(i, j int) bool {
+		return vfs[i].Address < vfs[j].Address
+	})
+}
+
+// slug lower cases a name and replaces anything but letters and digits with
+// dashes, e.g. "DSC Ethernet Controller VF" -> "dsc-ethernet-controller-vf"
+func slug(name string) string {
+	return strings.Trim(nonSlugChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
@@ -0,0 +1,195 @@
+package vf
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/shared/hclspec"
+	"github.com/vishvananda/netlink"
+
+	"github.com/david-gurley/host"
+)
+
+const (
+	guardActionExclude   = "exclude"
+	guardActionUnhealthy = "unhealthy"
+)
+
+// guardSpec is the hcl spec of the guard block
+func guardSpec() *hclspec.Spec {
+	return hclspec.NewBlock("guard", false, hclspec.NewObject(map[string]*hclspec.Spec{
+		"action": hclspec.NewDefault(
+			hclspec.NewAttr("action", "string", false),
+			hclspec.NewLiteral("\"exclude\""),
+		),
+		"host_ip":              hclspec.NewAttr("host_ip", "bool", false),
+		"default_route":        hclspec.NewAttr("default_route", "bool", false),
+		"bond_member":          hclspec.NewAttr("bond_member", "bool", false),
+		"vlan":                 hclspec.NewAttr("vlan", "bool", false),
+		"protected_interfaces": hclspec.NewAttr("protected_interfaces", "list(string)", false),
+	}))
+}
+
+// GuardConfig is the guard block, keeping devices used by the host from
+// being advertised. Each check looks at the network interface of the device;
+// protected interfaces also cover the vfs of a protected pf.
+type GuardConfig struct {
+	Action              string   `codec:"action"`
+	HostIP              bool     `codec:"host_ip"`
+	DefaultRoute        bool     `codec:"default_route"`
+	BondMember          bool     `codec:"bond_member"`
+	Vlan                bool     `codec:"vlan"`
+	ProtectedInterfaces []string `codec:"protected_interfaces"`
+}
+
+// guard checks whether the host uses a device. A nil guard checks nothing.
+type guard struct {
+	exclude      bool
+	hostIP       bool
+	defaultRoute bool
+	bondMember   bool
+	vlan         bool
+	protected    []string
+}
+
+func newGuard(c GuardConfig) (*guard, error) {
+	if !c.HostIP && !c.DefaultRoute && !c.BondMember && !c.Vlan && len(c.ProtectedInterfaces) == 0 {
+		return nil, nil
+	}
+	g := &guard{
+		hostIP:       c.HostIP,
+		defaultRoute: c.DefaultRoute,
+		bondMember:   c.BondMember,
+		vlan:         c.Vlan,
+		protected:    c.ProtectedInterfaces,
+	}
+	switch c.Action {
+	case guardActionExclude, "":
+		g.exclude = true
+	case guardActionUnhealthy:
+	default:
+		return nil, fmt.Errorf("invalid guard action %q, must be %q or %q", c.Action, guardActionExclude, guardActionUnhealthy)
+	}
+	for _, pattern := range g.protected {
+		if err := validateGlob(pattern); err != nil {
+			return nil, fmt.Errorf("invalid protected interface %q: %v", pattern, err)
+		}
+	}
+	return g, nil
+}
+
+// guardLinks indexes the host links for the vlan check
+type guardLinks map[int][]netlink.Link
+
+// readGuardLinks lists the links by parent index, only when the vlan check is
+// enabled
+func (g *guard) readGuardLinks() guardLinks {
+	links := make(guardLinks)
+	if g == nil || !g.vlan {
+		return links
+	}
+	all, err := netlink.LinkList()
+	if err != nil {
+		return links
+	}
+	for _, l := range all {
+		if parent := l.Attrs().ParentIndex; parent != 0 {
+			links[parent] = append(links[parent], l)
+		}
+	}
+	return links
+}
+
+// Check returns why the host uses a device, or an empty string
+func (g *guard) Check(vf *host.Vf, pf *host.Pf, links guardLinks) string {
+	if g == nil {
+		return ""
+	}
+	iface := vf.InterfaceName
+	if iface == "" && vf.Address == vf.PfAddress {
+		iface = netdevName(vf.Address)
+	}
+	for _, pattern := range g.protected {
+		if iface != "" && globMatch(pattern, iface) {
+			return fmt.Sprintf("interface %s is protected", iface)
+		}
+		if pf != nil && pf.InterfaceName != "" && vf.Address != vf.PfAddress && globMatch(pattern, pf.InterfaceName) {
+			return fmt.Sprintf("pf interface %s is protected", pf.InterfaceName)
+		}
+	}
+	if iface == "" {
+		return ""
+	}
+	if g.hostIP {
+		if ips := hostIPs(iface); len(ips) != 0 {
+			return fmt.Sprintf("interface %s has host ip addresses %s", iface, strings.Join(ips, ","))
+		}
+	}
+	if g.bondMember {
+		if bond := bondMaster(iface); bond != "" {
+			return fmt.Sprintf("interface %s is a member of bond %s", iface, bond)
+		}
+	}
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return ""
+	}
+	if g.defaultRoute && link.Attrs().Flags&net.FlagUp != 0 && hasDefaultRoute(link) {
+		return fmt.Sprintf("interface %s is up with a default route", iface)
+	}
+	if g.vlan {
+		for _, l := range links[link.Attrs().Index] {
+			if l.Type() == "vlan" {
+				return fmt.Sprintf("interface %s has vlan subinterface %s", iface, l.Attrs().Name)
+			}
+		}
+	}
+	return ""
+}
+
+// hasDefaultRoute reports whether a default route goes out of a link
+func hasDefaultRoute(link netlink.Link) bool {
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+	}, netlink.RT_FILTER_OIF)
+	if err != nil {
+		return false
+	}
+	for _, r := range routes {
+		if r.Dst == nil || r.Dst.IP.IsUnspecified() {
+			return true
+		}
+	}
+	return false
+}
+
+// applyGuard checks the devices against the guard. Excluded devices are
+// dropped, otherwise the reasons are returned by address to mark the devices
+// unhealthy. New reasons are logged.
+func (d *VfDevicePlugin) applyGuard(vfs host.Vfs, pfsMap map[string]*host.Pf) (host.Vfs, map[string]string) {
+	reasons := make(map[string]string)
+	if d.guard == nil {
+		return vfs, reasons
+	}
+	links := d.guard.readGuardLinks()
+	guarded := make(map[string]string)
+	kept := make(host.Vfs, 0, len(vfs))
+	for _, vf := range vfs {
+		reason := d.guard.Check(vf, pfsMap[vf.PfAddress], links)
+		if reason == "" {
+			kept = append(kept, vf)
+			continue
+		}
+		if d.guarded[vf.Address] != reason {
+			d.logger.Warn("device used by the host", "device", vf.Address, "reason", reason, "excluded", d.guard.exclude)
+		}
+		guarded[vf.Address] = reason
+		if !d.guard.exclude {
+			reasons[vf.Address] = "guard: " + reason
+			kept = append(kept, vf)
+		}
+	}
+	d.guarded = guarded
+	return kept, reasons
+}
@@ -0,0 +1,86 @@
+package vf
+
+import (
+	"strings"
+)
+
+// health accumulates the health of a device over several checks. Failed
+// checks make the device unhealthy, degraded ones only describe it.
+type health struct {
+	healthy bool
+	descs   []string
+}
+
+func newHealth() *health {
+	return &health{healthy: true}
+}
+
+// degrade records a problem that does not make the device unhealthy
+func (h *health) degrade(desc string) {
+	if desc != "" {
+		h.descs = append(h.descs, desc)
+	}
+}
+
+// fail marks the device unhealthy
+func (h *health) fail(desc string) {
+	if desc != "" {
+		h.healthy = false
+		h.descs = append(h.descs, desc)
+	}
+}
+
+// merge adds the checks of another health
+func (h *health) merge(other *health) {
+	if other == nil {
+		return
+	}
+	h.healthy = h.healthy && other.healthy
+	h.descs = append(h.descs, other.descs...)
+}
+
+// Desc is the nomad health description of the device
+func (h *health) Desc() string {
+	return strings.Join(h.descs, "; ")
+}
+
+// fingerprintHealth is what the health of the vfs is derived from during a
+// fingerprint
+type fingerprintHealth struct {
+	links map[string]*pcieLink
+	// aer maps pf and vf addresses to their aer health description
+	aer map[string]string
+	// guarded maps device addresses to why the host uses them
+	guarded map[string]string
+	// iommu maps device addresses to why their iommu group is not viable
+	iommu map[string]string
+	// devlink maps pf addresses to the health of their devlink reporters
+	devlink map[string]*health
+	// preflight describes the failed host preflight checks, which only
+	// concern devices handed out through vfio
+	preflight string
+}
+
+// instanceHealth returns the health of a device, which is unhealthy when any
+// of its vfs is. The preflight checks apply to vfio devices only.
+func (f *fingerprintHealth) instanceHealth(instance *deviceInstance, vfio bool) *health {
+	h := newHealth()
+	if vfio {
+		h.fail(f.preflight)
+	}
+	pfs := make(map[string]bool)
+	for _, vf := range instance.Devices {
+		if !pfs[vf.PfAddress] {
+			pfs[vf.PfAddress] = true
+			h.degrade(f.links[vf.PfAddress].HealthDesc())
+			h.fail(f.aer[vf.PfAddress])
+			h.merge(f.devlink[vf.PfAddress])
+		}
+		if vf.Address != vf.PfAddress {
+			h.fail(f.aer[vf.Address])
+		}
+		h.fail(f.iommu[vf.Address])
+		h.fail(f.guarded[vf.Address])
+	}
+	return h
+}
@@ -0,0 +1,96 @@
+package vf
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/david-gurley/host"
+)
+
+const (
+	// attributes for device groups (device identity)
+	StableIDsAttr = "stable_ids"
+
+	// deviceIDEnv prefixes the environment variables holding the device id
+	// of every reserved vf, indexed like DEVICE_VF_<vendor>_<i>
+	deviceIDEnv = "VF_ID_"
+)
+
+// stableID builds the logical id of a vf from the device serial number of its
+// pf, the pf function and the vf index, e.g. "b8599f0300d28cf0-pf1-vf3". It
+// survives slot moves, bus renumbering and re-creating the vfs. An empty
+// string is returned when the pf has no serial number.
+func stableID(serial string, pfAddress string, index int) string {
+	if serial == "" || index < 0 {
+		return ""
+	}
+	function := pfAddress[strings.LastIndex(pfAddress, ".")+1:]
+	return fmt.Sprintf("%s-pf%s-vf%d", strings.Replace(serial, "-", "", -1), function, index)
+}
+
+// pfStableID is stableID for a pf passed through whole, e.g.
+// "b8599f0300d28cf0-pf1"
+func pfStableID(serial string, pfAddress string) string {
+	if serial == "" {
+		return ""
+	}
+	function := pfAddress[strings.LastIndex(pfAddress, ".")+1:]
+	return fmt.Sprintf("%s-pf%s", strings.Replace(serial, "-", "", -1), function)
+}
+
+// deviceIDs maps the address of every vf to its device id, the stable id when
+// available and the pci address otherwise. Pfs in different slots may report
+// the same serial number, see pfPorts, so vfs whose stable id is not unique
+// fall back to their pci address too. vfs has to hold every enumerated vf,
+// allocated or not, for the fallback not to change with allocations.
+func deviceIDs(vfs host.Vfs, ports map[string]*port) map[string]string {
+	ids := make(map[string]string, len(vfs))
+	users := make(map[string]int, len(vfs))
+	indexes := make(map[string]map[string]int)
+	for _, vf := range vfs {
+		if indexes[vf.PfAddress] == nil {
+			indexes[vf.PfAddress] = vfIndexes(vf.PfAddress)
+		}
+		index, ok := indexes[vf.PfAddress][vf.Address]
+		if !ok {
+			index = -1
+		}
+		var serial string
+		if p := ports[vf.PfAddress]; p != nil {
+			serial = p.Serial
+		}
+		id := stableID(serial, vf.PfAddress, index)
+		if vf.Address == vf.PfAddress {
+			id = pfStableID(serial, vf.Address)
+		}
+		if id == "" {
+			id = vf.Address
+		}
+		ids[vf.Address] = id
+		users[id]++
+	}
+	for address, id := range ids {
+		if users[id] > 1 {
+			ids[address] = address
+		}
+	}
+	return ids
+}
+
+// hasStableIDs reports whether every vf has a stable id
+func hasStableIDs(vfs host.Vfs, ids map[string]string) bool {
+	for _, vf := range vfs {
+		if id, ok := ids[vf.Address]; !ok || id == vf.Address {
+			return false
+		}
+	}
+	return true
+}
+
+// deviceID returns the device id of a vf
+func deviceID(vf *host.Vf, ids map[string]string) string {
+	if id, ok := ids[vf.Address]; ok {
+		return id
+	}
+	return vf.Address
+}
@@ -0,0 +1,163 @@
+package vf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// irqAffinityLocal pins the irqs of a vf to the cpus local to it
+	irqAffinityLocal = "local"
+)
+
+var (
+	cpulistPattern = regexp.MustCompile(`^[0-9]+(-[0-9]+)?(,[0-9]+(-[0-9]+)?)*$`)
+)
+
+// irqPinner pins the msi/msi-x interrupts of pci devices to a cpu list. The
+// sysfs and procfs roots are fields so it can run against a fake tree.
+type irqPinner struct {
+	sysRoot  string
+	procRoot string
+	// affinity is irqAffinityLocal or a cpu list such as "2-5,8"
+	affinity string
+}
+
+// newIrqPinner validates the irq_affinity setting, an empty affinity disables
+// pinning and returns nil
+func newIrqPinner(affinity string) (*irqPinner, error) {
+	if affinity == "" {
+		return nil, nil
+	}
+	if affinity != irqAffinityLocal && !cpulistPattern.MatchString(affinity) {
+		return nil, fmt.Errorf("invalid irq_affinity %q, must be %q or a cpu list", affinity, irqAffinityLocal)
+	}
+	return &irqPinner{
+		sysRoot:  sysfsRoot,
+		procRoot: "/proc",
+		affinity: affinity,
+	}, nil
+}
+
+// irqs returns the msi irq numbers of a pci device. Devices without msi
+// enabled, e.g. vfio devices not yet opened, have none.
+func (p *irqPinner) irqs(address string) ([]int, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(p.sysRoot, "bus", "pci", "devices", address, "msi_irqs"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	irqs := make([]int, 0, len(entries))
+	for _, e := range entries {
+		irq, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		irqs = append(irqs, irq)
+	}
+	sort.Ints(irqs)
+	return irqs, nil
+}
+
+// cpus returns the cpu list the irqs of a device are pinned to
+func (p *irqPinner) cpus(address string) (string, error) {
+	if p.affinity != irqAffinityLocal {
+		return p.affinity, nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(p.sysRoot, "bus", "pci", "devices", address, "local_cpulist"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read local cpus of %s: %v", address, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (p *irqPinner) affinityPath(irq int) string {
+	return filepath.Join(p.procRoot, "irq", strconv.Itoa(irq), "smp_affinity_list")
+}
+
+// Pin pins the irqs of a device that are not in previous yet, and records
+// their former affinity in previous so it can be restored. On error the irqs
+// pinned by this call are restored.
+func (p *irqPinner) Pin(address string, previous map[int]string) error {
+	irqs, err := p.irqs(address)
+	if err != nil {
+		return err
+	}
+	cpus, err := p.cpus(address)
+	if err != nil {
+		return err
+	}
+	pinned := make(map[int]string)
+	for _, irq := range irqs {
+		if _, ok := previous[irq]; ok {
+			continue
+		}
+		b, err := ioutil.ReadFile(p.affinityPath(irq))
+		if err != nil {
+			p.Restore(pinned)
+			return fmt.Errorf("failed to read affinity of irq %d: %v", irq, err)
+		}
+		if err := ioutil.WriteFile(p.affinityPath(irq), []byte(cpus), 0644); err != nil {
+			p.Restore(pinned)
+			return fmt.Errorf("failed to pin irq %d to %s: %v", irq, cpus, err)
+		}
+		pinned[irq] = strings.TrimSpace(string(b))
+	}
+	for irq, affinity := range pinned {
+		previous[irq] = affinity
+	}
+	return nil
+}
+
+// Restore writes back the recorded affinities. irqs freed since they were
+// pinned are skipped.
+func (p *irqPinner) Restore(previous map[int]string) error {
+	var errs []string
+	for irq, affinity := range previous {
+		err := ioutil.WriteFile(p.affinityPath(irq), []byte(affinity), 0644)
+		if err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Sprintf("irq %d: %v", irq, err))
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("failed to restore irq affinity: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// pinReservedIrqs pins the irqs of the active reservations. It runs at
+// Reserve and on every fingerprint, since a vfio device only gets its irqs
+// once the task enables msi-x.
+func (d *VfDevicePlugin) pinReservedIrqs() {
+	if d.irqPinner == nil {
+		return
+	}
+	d.reservationLock.Lock()
+	defer d.reservationLock.Unlock()
+	for _, r := range d.reservations {
+		if r.IrqAffinity == nil {
+			r.IrqAffinity = make(map[int]string)
+		}
+		if err := d.irqPinner.Pin(r.Address, r.IrqAffinity); err != nil {
+			d.logger.Warn("failed to pin vf irqs", "vf", r.Address, "error", err)
+		}
+	}
+}
+
+// restoreIrqs restores the irq affinity of a released reservation
+func (d *VfDevicePlugin) restoreIrqs(r *reservation) {
+	if d.irqPinner == nil || len(r.IrqAffinity) == 0 {
+		return
+	}
+	if err := d.irqPinner.Restore(r.IrqAffinity); err != nil {
+		d.logger.Warn("failed to restore vf irqs", "vf", r.Address, "error", err)
+	}
+}
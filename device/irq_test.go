@@ -0,0 +1,131 @@
+package vf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeIrqTree creates the msi_irqs of a device under sysRoot and the
+// smp_affinity_list of every irq under procRoot, all starting at affinity
+func fakeIrqTree(t *testing.T, address string, irqs []int, affinity string) *irqPinner {
+	t.Helper()
+	root := t.TempDir()
+	p := &irqPinner{
+		sysRoot:  filepath.Join(root, "sys"),
+		procRoot: filepath.Join(root, "proc"),
+	}
+	device := filepath.Join(p.sysRoot, "bus", "pci", "devices", address)
+	msiIrqs := filepath.Join(device, "msi_irqs")
+	if err := os.MkdirAll(msiIrqs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(device, "local_cpulist"), []byte("0-3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, irq := range irqs {
+		if err := ioutil.WriteFile(filepath.Join(msiIrqs, strconv.Itoa(irq)), []byte("msix\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(p.affinityPath(irq)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p.affinityPath(irq), []byte(affinity+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p
+}
+
+func readAffinity(t *testing.T, p *irqPinner, irq int) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(p.affinityPath(irq))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func TestIrqPinnerPinRestore(t *testing.T) {
+	address := "0000:3b:02.0"
+	p := fakeIrqTree(t, address, []int{120, 121}, "0-63")
+	p.affinity = "8-9"
+
+	previous := make(map[int]string)
+	if err := p.Pin(address, previous); err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[int]string{120: "0-63", 121: "0-63"}; !reflect.DeepEqual(previous, expected) {
+		t.Errorf("expected previous affinity %v, got %v", expected, previous)
+	}
+	for _, irq := range []int{120, 121} {
+		if affinity := readAffinity(t, p, irq); affinity != "8-9" {
+			t.Errorf("irq %d: expected affinity 8-9, got %s", irq, affinity)
+		}
+	}
+
+	// pinning again keeps the affinity recorded the first time
+	if err := p.Pin(address, previous); err != nil {
+		t.Fatal(err)
+	}
+	if previous[120] != "0-63" {
+		t.Errorf("expected previous affinity 0-63, got %s", previous[120])
+	}
+
+	if err := p.Restore(previous); err != nil {
+		t.Fatal(err)
+	}
+	for _, irq := range []int{120, 121} {
+		if affinity := readAffinity(t, p, irq); affinity != "0-63" {
+			t.Errorf("irq %d: expected restored affinity 0-63, got %s", irq, affinity)
+		}
+	}
+}
+
+func TestIrqPinnerPinLocal(t *testing.T) {
+	address := "0000:3b:02.1"
+	p := fakeIrqTree(t, address, []int{130}, "0-63")
+	p.affinity = irqAffinityLocal
+
+	if err := p.Pin(address, make(map[int]string)); err != nil {
+		t.Fatal(err)
+	}
+	if affinity := readAffinity(t, p, 130); affinity != "0-3" {
+		t.Errorf("expected local affinity 0-3, got %s", affinity)
+	}
+}
+
+func TestIrqPinnerRestoreFreedIrq(t *testing.T) {
+	address := "0000:3b:02.2"
+	p := fakeIrqTree(t, address, []int{140}, "0-63")
+	p.affinity = "4"
+
+	previous := make(map[int]string)
+	if err := p.Pin(address, previous); err != nil {
+		t.Fatal(err)
+	}
+	// the irq was freed while the device was reserved
+	if err := os.RemoveAll(filepath.Dir(p.affinityPath(140))); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Restore(previous); err != nil {
+		t.Errorf("expected freed irqs to be skipped, got %v", err)
+	}
+}
+
+func TestIrqPinnerNoMsi(t *testing.T) {
+	p := fakeIrqTree(t, "0000:3b:02.3", nil, "")
+	p.affinity = "4"
+
+	previous := make(map[int]string)
+	if err := p.Pin("0000:3b:02.4", previous); err != nil {
+		t.Fatal(err)
+	}
+	if len(previous) != 0 {
+		t.Errorf("expected no pinned irqs, got %v", previous)
+	}
+}
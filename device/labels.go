@@ -0,0 +1,106 @@
+package vf
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/hashicorp/nomad/plugins/shared/hclspec"
+
+	"github.com/david-gurley/host"
+)
+
+var (
+	labelKeyPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.-]*$`)
+)
+
+// pfLabelsSpec is the hcl spec of the pf_labels blocks
+func pfLabelsSpec() *hclspec.Spec {
+	return hclspec.NewBlockList("pf_labels", hclspec.NewObject(map[string]*hclspec.Spec{
+		"address":     hclspec.NewAttr("address", "string", false),
+		"interface":   hclspec.NewAttr("interface", "string", false),
+		"labels":      hclspec.NewAttr("labels", "map(string)", true),
+		"pf_selector": pfSelectorSpec(),
+	}))
+}
+
+// PfLabelsConfig is a pf_labels block attaching labels to the pfs matching
+// its address, its interface name glob or its pf selectors. Labels of later
+// blocks override earlier ones.
+type PfLabelsConfig struct {
+	Address     string             `codec:"address"`
+	Interface   string             `codec:"interface"`
+	Labels      map[string]string  `codec:"labels"`
+	PfSelectors []PfSelectorConfig `codec:"pf_selector"`
+}
+
+type pfLabel struct {
+	selectors pfSelectors
+	labels    map[string]string
+}
+
+type pfLabels []*pfLabel
+
+func newPfLabels(configs []PfLabelsConfig) (pfLabels, error) {
+	labels := make(pfLabels, 0, len(configs))
+	for i, c := range configs {
+		selectorConfigs := c.PfSelectors
+		if c.Address != "" || c.Interface != "" {
+			selectorConfigs = append(selectorConfigs, PfSelectorConfig{
+				Match:     selectorMatchAll,
+				Address:   c.Address,
+				Interface: c.Interface,
+				NumaNode:  -1,
+			})
+		}
+		if len(selectorConfigs) == 0 {
+			return nil, fmt.Errorf("pf_labels %d: one of address, interface or pf_selector is required", i)
+		}
+		selectors, err := newPfSelectors(selectorConfigs)
+		if err != nil {
+			return nil, fmt.Errorf("pf_labels %d: %v", i, err)
+		}
+		for k := range c.Labels {
+			if !labelKeyPattern.MatchString(k) {
+				return nil, fmt.Errorf("pf_labels %d: invalid label key %q", i, k)
+			}
+		}
+		labels = append(labels, &pfLabel{selectors, c.Labels})
+	}
+	return labels, nil
+}
+
+// For returns the labels of a pf
+func (ls pfLabels) For(pf *host.Pf) map[string]string {
+	labels := make(map[string]string)
+	if pf == nil {
+		return labels
+	}
+	for _, l := range ls {
+		if !l.selectors.Matches(pf) {
+			continue
+		}
+		for k, v := range l.labels {
+			labels[k] = v
+		}
+	}
+	return labels
+}
+
+// commonLabels returns the labels shared, with the same value, by the pfs of
+// every vf in a group
+func (ls pfLabels) commonLabels(vfs host.Vfs, pfsMap map[string]*host.Pf) map[string]string {
+	var common map[string]string
+	for _, vf := range vfs {
+		labels := ls.For(pfsMap[vf.PfAddress])
+		if common == nil {
+			common = labels
+			continue
+		}
+		for k, v := range common {
+			if labels[k] != v {
+				delete(common, k)
+			}
+		}
+	}
+	return common
+}
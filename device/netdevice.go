@@ -0,0 +1,157 @@
+package vf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/david-gurley/host"
+)
+
+const (
+	// interfaceEnv, macEnv, vfIndexEnv and cniConfigEnv prefix the
+	// environment variables holding the interface, mac address, vf index and
+	// cni config of every reserved netdevice vf, indexed like
+	// DEVICE_VF_<vendor>_<i>
+	interfaceEnv = "VF_INTERFACE_"
+	macEnv       = "VF_MAC_"
+	vfIndexEnv   = "VF_INDEX_"
+	cniConfigEnv = "VF_CNI_CONFIG_"
+
+	cniVersion = "0.4.0"
+	// cniType is the sriov cni plugin moving the vf netdev into the task
+	// network namespace
+	cniType = "sriov"
+)
+
+// cniConfig is the network config of a netdevice vf in the format of the
+// sriov cni plugin, with the runtime args of the vf in args
+type cniConfig struct {
+	CniVersion string   `json:"cniVersion"`
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	DeviceID   string   `json:"deviceID"`
+	Mac        string   `json:"mac,omitempty"`
+	Args       *cniArgs `json:"args"`
+}
+
+type cniArgs struct {
+	Cni *cniRuntimeArgs `json:"cni"`
+}
+
+type cniRuntimeArgs struct {
+	DeviceID    string `json:"device_id"`
+	Interface   string `json:"interface"`
+	Mac         string `json:"mac,omitempty"`
+	VfIndex     int    `json:"vf_index"`
+	PfAddress   string `json:"pf_address"`
+	PfInterface string `json:"pf_interface,omitempty"`
+}
+
+// cniConfigPath is the cni config file of a reserved device
+func cniConfigPath(dir string, id string) string {
+	return filepath.Join(dir, slug(id)+".json")
+}
+
+// netdeviceReservation returns the interface, mac address and vf index of the
+// reserved vfs of netdevice pools, and writes their cni configs to dir. On
+// error the configs already written are removed.
+func netdeviceReservation(vfs host.Vfs, ids map[string]string, vfPools map[string]*pool, pfs map[string]*host.Pf, dir string) (_ map[string]string, err error) {
+	written := make([]string, 0)
+	defer func() {
+		if err != nil {
+			for _, path := range written {
+				os.Remove(path)
+			}
+		}
+	}()
+	envs := make(map[string]string)
+	for i, vf := range vfs {
+		p := vfPools[vf.Address]
+		if p == nil || p.Mode != poolModeNetdevice {
+			continue
+		}
+		iface := netdevName(vf.Address)
+		if iface == "" {
+			return nil, fmt.Errorf("vf %s has no network interface", vf.Address)
+		}
+		index, ok := vfIndexes(vf.PfAddress)[vf.Address]
+		if !ok {
+			return nil, fmt.Errorf("vf %s has no vf index on pf %s", vf.Address, vf.PfAddress)
+		}
+		mac := netdevMac(iface)
+		id := deviceID(vf, ids)
+		args := &cniRuntimeArgs{
+			DeviceID:  id,
+			Interface: iface,
+			Mac:       mac,
+			VfIndex:   index,
+			PfAddress: vf.PfAddress,
+		}
+		if pf := pfs[vf.PfAddress]; pf != nil {
+			args.PfInterface = pf.InterfaceName
+		}
+		path := cniConfigPath(dir, id)
+		if err := writeCniConfig(path, &cniConfig{
+			CniVersion: cniVersion,
+			Name:       p.Name,
+			Type:       cniType,
+			DeviceID:   vf.Address,
+			Mac:        mac,
+			Args:       &cniArgs{Cni: args},
+		}); err != nil {
+			return nil, err
+		}
+		written = append(written, path)
+		envs[fmt.Sprintf("%s%d", interfaceEnv, i)] = iface
+		envs[fmt.Sprintf("%s%d", macEnv, i)] = mac
+		envs[fmt.Sprintf("%s%d", vfIndexEnv, i)] = fmt.Sprintf("%d", index)
+		envs[fmt.Sprintf("%s%d", cniConfigEnv, i)] = path
+	}
+	return envs, nil
+}
+
+// writeCniConfig writes a cni config file
+func writeCniConfig(path string, config *cniConfig) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return fmt.Errorf("failed to write cni config %s: %v", path, err)
+	}
+	return nil
+}
+
+// netdeviceHeld reports whether the netdev of a vf left the host network
+// namespace, i.e. was moved into a task
+func netdeviceHeld(address string) bool {
+	driver := pciDriver(address)
+	return driver != "" && driver != vfioPciDriver && netdevName(address) == ""
+}
+
+// markNetdeviceAllocations marks the vfs of netdevice pools whose netdev was
+// moved into a task as allocated, vfio allocations do not cover them
+func (d *VfDevicePlugin) markNetdeviceAllocations(vfs host.Vfs, pfsMap map[string]*host.Pf) {
+	indexes := make(map[string]map[string]int)
+	for _, vf := range vfs {
+		if vf.Allocated {
+			continue
+		}
+		if indexes[vf.PfAddress] == nil {
+			indexes[vf.PfAddress] = vfIndexes(vf.PfAddress)
+		}
+		index, ok := indexes[vf.PfAddress][vf.Address]
+		if !ok {
+			continue
+		}
+		if p := d.pools.Assign(pfsMap[vf.PfAddress], index); p != nil && p.Mode == poolModeNetdevice {
+			vf.Allocated = netdeviceHeld(vf.Address)
+		}
+	}
+}
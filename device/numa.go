@@ -0,0 +1,98 @@
+package vf
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/david-gurley/host"
+)
+
+const (
+	// attributes for device groups (numa locality)
+	NumaNodeAttr     = "numa_node"
+	LocalCpulistAttr = "local_cpulist"
+
+	// environment variables set by Reserve when every reserved vf shares
+	// the same locality
+	numaNodeEnv     = "VF_NUMA_NODE"
+	localCpulistEnv = "VF_LOCAL_CPULIST"
+)
+
+// localCpulist returns the cpus local to a pci device, e.g. "0-15,32-47", or
+// an empty string when the kernel does not report it
+func localCpulist(address string) string {
+	cpus, err := host.ReadFileString(pciDevicePath(address, "local_cpulist"))
+	if err != nil {
+		return ""
+	}
+	return cpus
+}
+
+// splitNuma splits the groups whose vfs span several numa nodes into one
+// group per node, named <name>-numa<node>. vfs with an unknown node stay in
+// the original group. Bundles are never split.
+func splitNuma(groups map[string]*GroupMapping) map[string]*GroupMapping {
+	split := make(map[string]*GroupMapping, len(groups))
+	for key, group := range groups {
+		if group.Bundles != nil {
+			split[key] = group
+			continue
+		}
+		nodes := make(map[int]host.Vfs)
+		for _, vf := range group.Devices {
+			node := numaNode(vf.Address)
+			nodes[node] = append(nodes[node], vf)
+		}
+		if len(nodes) < 2 {
+			split[key] = group
+			continue
+		}
+		for node, vfs := range nodes {
+			g := &GroupMapping{
+				Devices: vfs,
+				Vendor:  group.Vendor,
+				Type:    group.Type,
+				Name:    group.Name,
+				Pool:    group.Pool,
+			}
+			if node >= 0 {
+				g.Name = fmt.Sprintf("%s-numa%d", group.Name, node)
+			}
+			split[g.Key()] = g
+		}
+	}
+	return split
+}
+
+// numaLocality returns the numa node and local cpus shared by every vf, or
+// -1 and an empty string when they differ
+func numaLocality(vfs host.Vfs) (int, string) {
+	node, cpus := -1, ""
+	for i, vf := range vfs {
+		n, c := numaNode(vf.Address), localCpulist(vf.Address)
+		if i == 0 {
+			node, cpus = n, c
+			continue
+		}
+		if n != node {
+			node = -1
+		}
+		if c != cpus {
+			cpus = ""
+		}
+	}
+	return node, cpus
+}
+
+// numaEnvs returns the locality environment variables of a reservation
+func numaEnvs(vfs host.Vfs) map[string]string {
+	envs := make(map[string]string)
+	node, cpus := numaLocality(vfs)
+	if node >= 0 {
+		envs[numaNodeEnv] = strconv.Itoa(node)
+	}
+	if cpus != "" {
+		envs[localCpulistEnv] = cpus
+	}
+	return envs
+}
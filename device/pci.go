@@ -0,0 +1,159 @@
+package vf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	vfioPciDriver = "vfio-pci"
+
+	// pci express extended capabilities live in config space from 0x100 on,
+	// the device serial number capability has id 3
+	pciExtCapStart = 0x100
+	pciExtCapDsn   = 0x0003
+)
+
+var (
+	// sysfsRoot is the mount point of sysfs, overridable for testing
+	sysfsRoot = "/sys"
+)
+
+// pciDevicePath returns the sysfs path of a pci device attribute
+func pciDevicePath(address string, elem ...string) string {
+	return filepath.Join(append([]string{sysfsRoot, "bus", "pci", "devices", address}, elem...)...)
+}
+
+// pciDriver returns the name of the driver bound to a pci device, or an empty
+// string when the device is unbound
+func pciDriver(address string) string {
+	d, err := filepath.EvalSymlinks(pciDevicePath(address, "driver"))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(d)
+}
+
+// vfAddresses maps the vf index of a pf to the pci address of the vf, using
+// the virtfnN links of the pf
+func vfAddresses(pfAddress string) map[int]string {
+	addresses := make(map[int]string)
+	links, err := filepath.Glob(pciDevicePath(pfAddress, "virtfn*"))
+	if err != nil {
+		return addresses
+	}
+	for _, link := range links {
+		index, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(link), "virtfn"))
+		if err != nil {
+			continue
+		}
+		target, err := os.Readlink(link)
+		if err != nil {
+			continue
+		}
+		addresses[index] = filepath.Base(target)
+	}
+	return addresses
+}
+
+// vfIndexes maps the pci address of every vf of a pf to its vf index
+func vfIndexes(pfAddress string) map[string]int {
+	indexes := make(map[string]int)
+	for index, address := range vfAddresses(pfAddress) {
+		indexes[address] = index
+	}
+	return indexes
+}
+
+// bindDriver rebinds a pci device to the given driver using driver_override,
+// which unlike new_id works for any number of devices sharing a vendor and
+// device id. An empty driver restores the default kernel driver.
+func bindDriver(address string, driver string) error {
+	if driver != "" && pciDriver(address) == driver {
+		return nil
+	}
+	override := driver
+	if override == "" {
+		override = "\n"
+	}
+	if err := writeSysfs(pciDevicePath(address, "driver_override"), override); err != nil {
+		return err
+	}
+	if pciDriver(address) != "" {
+		if err := writeSysfs(pciDevicePath(address, "driver", "unbind"), address); err != nil {
+			return err
+		}
+	}
+	if err := writeSysfs(filepath.Join(sysfsRoot, "bus", "pci", "drivers_probe"), address); err != nil {
+		return err
+	}
+	if driver != "" && pciDriver(address) != driver {
+		return fmt.Errorf("pci device %s did not bind to %s", address, driver)
+	}
+	return nil
+}
+
+// writeSysfs writes a value to an existing sysfs attribute
+func writeSysfs(path string, value string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(value); err != nil {
+		return fmt.Errorf("failed to write %q to %s: %v", value, path, err)
+	}
+	return nil
+}
+
+// pciDeviceSerial reads the pci express device serial number capability from
+// the config space of a device, formatted like lspci, e.g.
+// "b8-59-9f-03-00-d2-8c-f0". It returns an empty string when the device has
+// no serial number or the extended config space is not readable, which
+// requires root.
+func pciDeviceSerial(address string) string {
+	config, err := ioutil.ReadFile(pciDevicePath(address, "config"))
+	if err != nil || len(config) < pciExtCapStart+4 {
+		return ""
+	}
+	offset := pciExtCapStart
+	// bound the walk in case of a looping capability list
+	for i := 0; i < 64 && offset >= pciExtCapStart && offset+4 <= len(config); i++ {
+		header := binary.LittleEndian.Uint32(config[offset:])
+		if header == 0 || header == 0xffffffff {
+			return ""
+		}
+		if header&0xffff == pciExtCapDsn {
+			if offset+12 > len(config) {
+				return ""
+			}
+			serial := binary.LittleEndian.Uint64(config[offset+4:])
+			if serial == 0 {
+				return ""
+			}
+			b := make([]byte, 8)
+			binary.BigEndian.PutUint64(b, serial)
+			parts := make([]string, len(b))
+			for j, c := range b {
+				parts[j] = fmt.Sprintf("%02x", c)
+			}
+			return strings.Join(parts, "-")
+		}
+		offset = int(header >> 20)
+	}
+	return ""
+}
+
+// pciSlot returns the domain:bus:device part of a pci address, shared by
+// the functions of a multi-function device
+func pciSlot(address string) string {
+	if i := strings.LastIndex(address, "."); i >= 0 {
+		return address[:i]
+	}
+	return address
+}
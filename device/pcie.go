@@ -0,0 +1,140 @@
+package vf
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/shared/structs"
+
+	"github.com/david-gurley/host"
+)
+
+const (
+	// attributes for device groups (pf pcie link)
+	PcieLinkSpeedAttr    = "pcie_link_speed"
+	PcieLinkWidthAttr    = "pcie_link_width"
+	PcieMaxLinkSpeedAttr = "pcie_max_link_speed"
+	PcieMaxLinkWidthAttr = "pcie_max_link_width"
+	PcieRootPortAttr     = "pcie_root_port"
+	PcieUpstreamAttr     = "pcie_upstream"
+	PcieDegradedAttr     = "pcie_degraded"
+)
+
+var (
+	pciAddressPattern = regexp.MustCompile(`^[0-9a-f]{4}:[0-9a-f]{2}:[0-9a-f]{2}\.[0-7]$`)
+)
+
+// pcieLink is the negotiated and maximum link of a pci device, and the chain
+// of bridges from the root port down to it
+type pcieLink struct {
+	Speed    string
+	Width    int
+	MaxSpeed string
+	MaxWidth int
+	// Upstream lists the root port first, then any switch ports
+	Upstream []string
+}
+
+// readPcieLink reads the link of a pci device from sysfs, or returns nil when
+// the device reports no link, e.g. integrated devices
+func readPcieLink(address string) *pcieLink {
+	speed, err := host.ReadFileString(pciDevicePath(address, "current_link_speed"))
+	if err != nil {
+		return nil
+	}
+	link := &pcieLink{Speed: speed}
+	link.MaxSpeed, _ = host.ReadFileString(pciDevicePath(address, "max_link_speed"))
+	if width, err := host.ReadFileInt(pciDevicePath(address, "current_link_width")); err == nil {
+		link.Width = width
+	}
+	if width, err := host.ReadFileInt(pciDevicePath(address, "max_link_width")); err == nil {
+		link.MaxWidth = width
+	}
+	link.Upstream = pciUpstream(address)
+	return link
+}
+
+// pciUpstream returns the addresses of the bridges above a pci device, from
+// the sysfs device path, e.g. /sys/devices/pci0000:00/0000:00:03.0/0000:3b:00.0
+// gives [0000:00:03.0]
+func pciUpstream(address string) []string {
+	path, err := filepath.EvalSymlinks(pciDevicePath(address))
+	if err != nil {
+		return nil
+	}
+	upstream := make([]string, 0)
+	for _, elem := range strings.Split(filepath.Dir(path), string(filepath.Separator)) {
+		if pciAddressPattern.MatchString(elem) {
+			upstream = append(upstream, elem)
+		}
+	}
+	return upstream
+}
+
+// linkSpeedGTs parses a sysfs link speed such as "8.0 GT/s PCIe" or "8 GT/s"
+func linkSpeedGTs(speed string) (float64, bool) {
+	fields := strings.Fields(speed)
+	if len(fields) == 0 {
+		return 0, false
+	}
+	gts, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, false
+	}
+	return gts, true
+}
+
+// Degraded reports whether the link trained below its maximum speed or width
+func (l *pcieLink) Degraded() bool {
+	if l == nil {
+		return false
+	}
+	if l.MaxWidth > 0 && l.Width > 0 && l.Width < l.MaxWidth {
+		return true
+	}
+	speed, ok := linkSpeedGTs(l.Speed)
+	maxSpeed, maxOk := linkSpeedGTs(l.MaxSpeed)
+	return ok && maxOk && speed < maxSpeed
+}
+
+// HealthDesc describes a degraded link, e.g. "pcie link degraded: x4 8.0 GT/s
+// PCIe, capable of x16 8.0 GT/s PCIe"
+func (l *pcieLink) HealthDesc() string {
+	if !l.Degraded() {
+		return ""
+	}
+	return fmt.Sprintf("pcie link degraded: x%d %s, capable of x%d %s", l.Width, l.Speed, l.MaxWidth, l.MaxSpeed)
+}
+
+// attributes adds the link attributes to a device group
+func (l *pcieLink) attributes(attrs map[string]*structs.Attribute) {
+	if l == nil {
+		return
+	}
+	attrs[PcieLinkSpeedAttr] = &structs.Attribute{String: &l.Speed}
+	attrs[PcieLinkWidthAttr] = structs.NewIntAttribute(int64(l.Width), "")
+	if l.MaxSpeed != "" {
+		attrs[PcieMaxLinkSpeedAttr] = &structs.Attribute{String: &l.MaxSpeed}
+	}
+	attrs[PcieMaxLinkWidthAttr] = structs.NewIntAttribute(int64(l.MaxWidth), "")
+	if len(l.Upstream) != 0 {
+		root := l.Upstream[0]
+		upstream := strings.Join(l.Upstream, ",")
+		attrs[PcieRootPortAttr] = &structs.Attribute{String: &root}
+		attrs[PcieUpstreamAttr] = &structs.Attribute{String: &upstream}
+	}
+	degraded := l.Degraded()
+	attrs[PcieDegradedAttr] = &structs.Attribute{Bool: &degraded}
+}
+
+// readPcieLinks reads the link of every pf
+func readPcieLinks(pfsMap map[string]*host.Pf) map[string]*pcieLink {
+	links := make(map[string]*pcieLink, len(pfsMap))
+	for address := range pfsMap {
+		links[address] = readPcieLink(address)
+	}
+	return links
+}
@@ -0,0 +1,111 @@
+package vf
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jaypipes/pcidb"
+
+	"github.com/david-gurley/host"
+)
+
+var (
+	vendorShortName = regexp.MustCompile(`\[([^\]]+)\]`)
+	nonSlugChars    = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// pciNames resolves pci vendor and device names. Names from the operator
+// overlay win over the pci.ids database; when neither knows an id, the name
+// set by the host package from its built-in maps, or the raw hex id, is kept.
+type pciNames struct {
+	db      *pcidb.PCIDB
+	overlay *pcidb.PCIDB
+}
+
+// loadPciNames loads the pci.ids database from path, or from the system
+// locations when path is empty, and the optional overlay file which uses the
+// same format. The database is never fetched from the network.
+func loadPciNames(path string, overlayPath string) (*pciNames, error) {
+	names := &pciNames{}
+	opts := []*pcidb.WithOption{pcidb.WithDisableNetworkFetch()}
+	if path != "" {
+		opts = append(opts, pcidb.WithDirectPath(path))
+	}
+	db, err := pcidb.New(opts...)
+	if err != nil && path != "" {
+		return nil, fmt.Errorf("failed to load pci ids from %s: %v", path, err)
+	}
+	names.db = db
+	if overlayPath != "" {
+		overlay, err := pcidb.New(pcidb.WithDirectPath(overlayPath), pcidb.WithDisableNetworkFetch())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load pci ids overlay from %s: %v", overlayPath, err)
+		}
+		names.overlay = overlay
+	}
+	return names, nil
+}
+
+// VendorName returns the full vendor name for a hex vendor id, or an empty
+// string if it is unknown
+func (n *pciNames) VendorName(vendorID string) string {
+	id := trimHexID(vendorID)
+	for _, db := range []*pcidb.PCIDB{n.overlay, n.db} {
+		if db == nil {
+			continue
+		}
+		if vendor, ok := db.Vendors[id]; ok && vendor.Name != "" {
+			return vendor.Name
+		}
+	}
+	return ""
+}
+
+// DeviceName returns the device model name for a hex vendor and device id,
+// or an empty string if it is unknown
+func (n *pciNames) DeviceName(vendorID string, deviceID string) string {
+	id := trimHexID(vendorID) + trimHexID(deviceID)
+	for _, db := range []*pcidb.PCIDB{n.overlay, n.db} {
+		if db == nil {
+			continue
+		}
+		if product, ok := db.Products[id]; ok && product.Name != "" {
+			return product.Name
+		}
+	}
+	return ""
+}
+
+// resolveVf replaces the vendor and device names of a vf with the names
+// from the database, keeping the host names as fallback
+func (n *pciNames) resolveVf(vf *host.Vf) {
+	if name := n.VendorName(vf.VendorID); name != "" {
+		vf.Vendor = vendorSlug(name)
+	}
+	if name := n.DeviceName(vf.VendorID, vf.DeviceID); name != "" {
+		vf.Device = name
+	}
+}
+
+// resolvePf is resolveVf for pfs
+func (n *pciNames) resolvePf(pf *host.Pf) {
+	if name := n.VendorName(pf.VendorID); name != "" {
+		pf.Vendor = vendorSlug(name)
+	}
+	if name := n.DeviceName(pf.VendorID, pf.DeviceID); name != "" {
+		pf.Device = name
+	}
+}
+
+// vendorSlug turns a pci.ids vendor name into the short lower case name used
+// as the nomad device vendor, e.g. "Mellanox Technologies" -> "mellanox" and
+// "Advanced Micro Devices, Inc. [AMD]" -> "amd"
+func vendorSlug(name string) string {
+	if m := vendorShortName.FindStringSubmatch(name); m != nil {
+		name = m[1]
+	} else if fields := strings.Fields(name); len(fields) != 0 {
+		name = fields[0]
+	}
+	return slug(name)
+}
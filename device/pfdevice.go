@@ -0,0 +1,252 @@
+package vf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+
+	"github.com/hashicorp/nomad/plugins/shared/hclspec"
+
+	"github.com/david-gurley/host"
+)
+
+const (
+	pfDeviceType = "pf"
+)
+
+// pfDeviceSpec is the hcl spec of the pf_device blocks
+func pfDeviceSpec() *hclspec.Spec {
+	return hclspec.NewBlockList("pf_device", hclspec.NewObject(map[string]*hclspec.Spec{
+		"vendor_id":   hclspec.NewAttr("vendor_id", "string", false),
+		"device_id":   hclspec.NewAttr("device_id", "string", false),
+		"class":       hclspec.NewAttr("class", "string", false),
+		"address":     hclspec.NewAttr("address", "string", false),
+		"device_name": hclspec.NewAttr("device_name", "string", false),
+		"vfio":        hclspec.NewAttr("vfio", "bool", false),
+	}))
+}
+
+// PfDeviceConfig is a pf_device block selecting physical functions passed
+// through whole. Matching pfs bound to vfio-pci are advertised as
+// <vendor>/pf/<device_name>, the device name defaulting to the model.
+type PfDeviceConfig struct {
+	VendorID   string `codec:"vendor_id"`
+	DeviceID   string `codec:"device_id"`
+	Class      string `codec:"class"`
+	Address    string `codec:"address"`
+	DeviceName string `codec:"device_name"`
+	Vfio       bool   `codec:"vfio"`
+}
+
+type pfDevice struct {
+	selector   deviceSelector
+	deviceName string
+	vfio       bool
+}
+
+type pfDevices []*pfDevice
+
+func newPfDevices(configs []PfDeviceConfig) (pfDevices, error) {
+	devices := make(pfDevices, 0, len(configs))
+	for i, c := range configs {
+		selector, err := newDeviceSelector(DeviceSelectorConfig{
+			VendorID:  c.VendorID,
+			DeviceID:  c.DeviceID,
+			Class:     c.Class,
+			PfAddress: c.Address,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("pf_device %d: %v", i, err)
+		}
+		if c.DeviceName != "" && !poolNamePattern.MatchString(c.DeviceName) {
+			return nil, fmt.Errorf("pf_device %d: invalid device_name %q", i, c.DeviceName)
+		}
+		devices = append(devices, &pfDevice{selector, c.DeviceName, c.Vfio})
+	}
+	return devices, nil
+}
+
+// Match returns the pf_device block matching a pf, or nil
+func (ps pfDevices) Match(pf *host.Vf) *pfDevice {
+	class, _ := host.GetPciDeviceClass(pf.Address)
+	d := &selectedDevice{vf: pf, class: class}
+	for _, p := range ps {
+		if p.selector.Matches(d) {
+			return p
+		}
+	}
+	return nil
+}
+
+// readPfDevice reads a pf as a device. A whole pf is handed out like a vf
+// that is its own pf, so reservations, health and stats apply unchanged.
+func readPfDevice(address string) *host.Vf {
+	pf := readVf(address, false)
+	pf.PfAddress = address
+	return pf
+}
+
+// getPfDevices enumerates the pfs matching a pf_device block, with the block
+// that matched
+func (d *VfDevicePlugin) getPfDevices() (map[*host.Vf]*pfDevice, error) {
+	devices := make(map[*host.Vf]*pfDevice)
+	if len(d.pfDevices) == 0 {
+		return devices, nil
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(sysfsRoot, "bus", "pci", "devices"))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if isVf(e.Name()) {
+			continue
+		}
+		pf := readPfDevice(e.Name())
+		if p := d.pfDevices.Match(pf); p != nil {
+			devices[pf] = p
+		}
+	}
+	return devices, nil
+}
+
+// fingerprintPfDevices returns the pf devices to advertise: the matching pfs
+// bound to vfio-pci
+func (d *VfDevicePlugin) fingerprintPfDevices(allocations []string) (host.Vfs, map[string]*pfDevice, error) {
+	devices, err := d.getPfDevices()
+	if err != nil {
+		return nil, nil, err
+	}
+	pfs := make(host.Vfs, 0, len(devices))
+	blocks := make(map[string]*pfDevice, len(devices))
+	for pf, p := range devices {
+		if pf.Driver != vfioPciDriver {
+			continue
+		}
+		pf.Allocated = host.IsAllocated(allocations, pf.IommuGroup)
+		pfs = append(pfs, pf)
+		blocks[pf.Address] = p
+	}
+	return pfs, blocks, nil
+}
+
+// applyPfDevices binds the pfs of the pf_device blocks that set vfio. It runs
+// once at startup and refuses pfs that are in use by the host.
+func (d *VfDevicePlugin) applyPfDevices() {
+	devices, err := d.getPfDevices()
+	if err != nil {
+		d.logger.Error("failed to get pf devices", "error", err)
+		return
+	}
+	for pf, p := range devices {
+		if !p.vfio || pf.Driver == vfioPciDriver {
+			continue
+		}
+		if reason := pfInUse(pf.Address); reason != "" {
+			d.logger.Warn("refusing to bind pf to vfio-pci", "pf", pf.Address, "reason", reason)
+			continue
+		}
+		if err := bindDriver(pf.Address, vfioPciDriver); err != nil {
+			d.logger.Error("failed to bind pf to vfio-pci", "pf", pf.Address, "error", err)
+		}
+	}
+}
+
+// pfInUse returns why a pf can not be taken away from the host, or an empty
+// string: it has vfs, carries host ip addresses or is a bond member
+func pfInUse(address string) string {
+	if numVfs, err := host.ReadFileInt(pciDevicePath(address, "sriov_numvfs")); err == nil && numVfs > 0 {
+		return fmt.Sprintf("%d vfs enabled", numVfs)
+	}
+	iface := netdevName(address)
+	if iface == "" {
+		return ""
+	}
+	if ips := hostIPs(iface); len(ips) != 0 {
+		return fmt.Sprintf("interface %s has host ip addresses %v", iface, ips)
+	}
+	if bond := bondMaster(iface); bond != "" {
+		return fmt.Sprintf("interface %s is a member of bond %s", iface, bond)
+	}
+	return ""
+}
+
+// hostIPs returns the non link-local ip addresses of an interface
+func hostIPs(interfaceName string) []string {
+	iface, err := net.InterfaceByName(interfaceName)
+	if err != nil {
+		return nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	ips := make([]string, 0)
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ips = append(ips, ipNet.String())
+	}
+	return ips
+}
+
+// groupPfDevices adds the device groups of the pf devices
+func groupPfDevices(pfs host.Vfs, blocks map[string]*pfDevice, groups map[string]*GroupMapping) {
+	for _, pf := range pfs {
+		group := &GroupMapping{
+			Vendor: pf.Vendor,
+			Type:   pfDeviceType,
+			Name:   blocks[pf.Address].deviceName,
+		}
+		if group.Name == "" {
+			group.Name = slug(pf.Device)
+		}
+		if existing, ok := groups[group.Key()]; ok {
+			group = existing
+		} else {
+			groups[group.Key()] = group
+		}
+		group.Devices = append(group.Devices, pf)
+	}
+	for _, group := range groups {
+		if group.Type == pfDeviceType {
+			sortVfs(group.Devices)
+		}
+	}
+}
+
+// checkIommuViable maps the addresses of the devices whose iommu group is
+// not viable to the reason
+func checkIommuViable(devices host.Vfs) map[string]string {
+	descs := make(map[string]string)
+	for _, d := range devices {
+		if desc := iommuViable(d.Address); desc != "" {
+			descs[d.Address] = desc
+		}
+	}
+	return descs
+}
+
+// iommuViable returns why the iommu group of a device can not be opened
+// through vfio, or an empty string. Every endpoint in the group has to be
+// bound to vfio-pci or to no driver.
+func iommuViable(address string) string {
+	group := host.IommuGroup(address)
+	if group == "" {
+		return "no iommu group"
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(sysfsRoot, "kernel", "iommu_groups", group, "devices"))
+	if err != nil {
+		return fmt.Sprintf("iommu group %s: %v", group, err)
+	}
+	for _, e := range entries {
+		driver := pciDriver(e.Name())
+		if driver == "" || driver == vfioPciDriver || driver == "pcieport" {
+			continue
+		}
+		return fmt.Sprintf("iommu group %s not viable, %s is bound to %s", group, e.Name(), driver)
+	}
+	return ""
+}
@@ -0,0 +1,253 @@
+package vf
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/david-gurley/host"
+)
+
+// SriovPolicyConfig is a single sriov_policy block of the plugin config. It
+// selects pfs and describes how their vfs should be provisioned.
+type SriovPolicyConfig struct {
+	VendorRegexp string             `codec:"vendor_regexp"`
+	NumVfs       *int               `codec:"num_vfs"`
+	MaxVfs       bool               `codec:"max_vfs"`
+	Vfio         bool               `codec:"vfio"`
+	EswitchMode  string             `codec:"eswitch_mode"`
+	PfSelectors  []PfSelectorConfig `codec:"pf_selector"`
+}
+
+// sriovPolicy pairs a host pf-policy with the plugin specific options that
+// the host engine does not know about
+type sriovPolicy struct {
+	policy    *host.PfPolicy
+	vendor    *regexp.Regexp
+	selectors pfSelectors
+	// numVfs is nil when the policy leaves the vf count as is
+	numVfs  *int
+	vfio    bool
+	eswitch string
+}
+
+// newSriovPolicies validates the sriov_policy blocks and builds the host
+// pf-policies from them
+func newSriovPolicies(configs []SriovPolicyConfig) ([]*sriovPolicy, error) {
+	policies := make([]*sriovPolicy, 0, len(configs))
+	for i, c := range configs {
+		if c.NumVfs != nil && *c.NumVfs < 0 {
+			return nil, fmt.Errorf("sriov_policy %d: num_vfs must not be negative", i)
+		}
+		if c.MaxVfs && c.NumVfs != nil {
+			return nil, fmt.Errorf("sriov_policy %d: num_vfs and max_vfs are mutually exclusive", i)
+		}
+		vendorRegexp := c.VendorRegexp
+		if vendorRegexp == "" {
+			vendorRegexp = host.PF_SELECTOR_VENDOR_REGEXP_DEFAULT
+		}
+		numVfs := 0
+		if c.NumVfs != nil {
+			numVfs = *c.NumVfs
+		}
+		policy, err := host.NewPfPolicy(
+			&host.PfSelectorOptions{
+				Kind:         host.PF_SELECTOR_KIND_VENDOR_REGEXP,
+				VendorRegexp: vendorRegexp,
+			},
+			&host.PfPolicyOptions{
+				MaxVfs: c.MaxVfs,
+				NumVfs: numVfs,
+			},
+		)
+		if err != nil {
+			return nil, fmt.Errorf("sriov_policy %d: invalid vendor_regexp %q: %v", i, vendorRegexp, err)
+		}
+		selectors, err := newPfSelectors(c.PfSelectors)
+		if err != nil {
+			return nil, fmt.Errorf("sriov_policy %d: %v", i, err)
+		}
+		if err := validateEswitchMode(c.EswitchMode); err != nil {
+			return nil, fmt.Errorf("sriov_policy %d: %v", i, err)
+		}
+		policies = append(policies, &sriovPolicy{
+			policy:    policy,
+			vendor:    regexp.MustCompile(vendorRegexp),
+			selectors: selectors,
+			numVfs:    c.NumVfs,
+			vfio:      c.Vfio,
+			eswitch:   c.EswitchMode,
+		})
+	}
+	return policies, nil
+}
+
+// applySriovPolicies plans every configured sriov policy against the local
+// pfs, logs the resulting diff and applies it. Errors are logged per pf so a
+// single bad pf does not stop the remaining ones from being provisioned.
+func (d *VfDevicePlugin) applySriovPolicies(ctx context.Context) {
+	if len(d.sriovPolicies) == 0 {
+		return
+	}
+	hostID, err := host.GetHostID()
+	if err != nil {
+		d.logger.Error("failed to get host id for sriov policy", "error", err)
+		return
+	}
+	for _, p := range d.sriovPolicies {
+		pfs, err := d.getPfs()
+		if err != nil {
+			d.logger.Error("failed to get pfs for sriov policy", "error", err)
+			return
+		}
+		for _, pf := range pfs {
+			d.pciNames.resolvePf(pf)
+		}
+		if err := p.plan(hostID, pfs); err != nil {
+			d.logger.Error("failed to plan sriov policy", "error", err)
+			continue
+		}
+		for address, plan := range p.policy.PfPlan[hostID] {
+			current := plan[host.PF_POLICY_CURRENT]
+			planned := plan[host.PF_POLICY_PLANNED]
+			d.logger.Info("sriov policy plan", "pf", address, "interface", current.InterfaceName,
+				"vendor", current.Vendor, "total_vfs", current.TotalVfs,
+				"num_vfs", fmt.Sprintf("%d -> %d", current.NumVfs, planned.NumVfs), "vfio", p.vfio,
+				"eswitch_mode", p.eswitch)
+		}
+		pfConfigs, err := p.policy.ApplyConcrete(hostID)
+		if err != nil {
+			d.logger.Error("failed to apply sriov policy", "error", err)
+			continue
+		}
+		for _, pfConfig := range *pfConfigs {
+			pfConfig.Vfio = p.vfio
+			deferred := &deferredPfConfig{
+				config:   pfConfig,
+				current:  p.policy.PfPlan[hostID][pfConfig.Address][host.PF_POLICY_CURRENT],
+				eswitch:  p.eswitch,
+				deadline: time.Now().Add(d.resizeTimeout),
+			}
+			err := d.provisionPf(ctx, deferred)
+			if _, inUse := err.(*resizeInUseError); inUse && d.resizeInUse == resizeInUseWait {
+				d.logger.Info("vfs in use, retrying sriov policy on the next fingerprints", "pf", pfConfig.Address, "error", err)
+				d.deferredPfConfigs = append(d.deferredPfConfigs, deferred)
+				continue
+			}
+			if err != nil {
+				d.logger.Error("failed to apply sriov policy to pf", "pf", pfConfig.Address, "error", err)
+			}
+		}
+	}
+}
+
+// deferredPfConfig is a pf config whose resize waits for the vfs of the pf to
+// be released, until deadline
+type deferredPfConfig struct {
+	config   host.PfConfig
+	current  *host.Pf
+	eswitch  string
+	deadline time.Time
+}
+
+// provisionPf applies a pf config and switches the eswitch mode of the pf
+func (d *VfDevicePlugin) provisionPf(ctx context.Context, c *deferredPfConfig) error {
+	if err := d.applyPfConfig(ctx, c.config, c.current); err != nil {
+		return err
+	}
+	if c.eswitch == "" {
+		return nil
+	}
+	if err := setEswitchMode(c.config.Address, c.eswitch); err != nil {
+		d.logger.Error("failed to set pf eswitch mode", "pf", c.config.Address, "mode", c.eswitch, "error", err)
+	}
+	return nil
+}
+
+// retryDeferredPfConfigs retries the pf configs whose vfs were in use, once
+// per fingerprint so the startup does not block on them. It reports whether
+// any pf was provisioned.
+func (d *VfDevicePlugin) retryDeferredPfConfigs(ctx context.Context) bool {
+	provisioned := false
+	pending := make([]*deferredPfConfig, 0, len(d.deferredPfConfigs))
+	for _, c := range d.deferredPfConfigs {
+		err := d.provisionPf(ctx, c)
+		_, inUse := err.(*resizeInUseError)
+		switch {
+		case inUse && time.Now().Before(c.deadline):
+			pending = append(pending, c)
+		case err != nil:
+			d.logger.Error("failed to apply sriov policy to pf", "pf", c.config.Address, "error", err)
+		default:
+			d.logger.Info("applied deferred sriov policy", "pf", c.config.Address)
+			provisioned = true
+		}
+	}
+	d.deferredPfConfigs = pending
+	return provisioned
+}
+
+// plan selects the pfs matching both the vendor regexp and the pf selectors
+// and runs the host pf-policy planner over them. The host planner only
+// changes num_vfs on pfs that already have vfs enabled and aliases every
+// current entry to the same pf, so the plan is rebuilt from the selection
+// afterwards.
+func (p *sriovPolicy) plan(hostID string, pfs host.Pfs) error {
+	selected := make(map[string][]host.Pf)
+	for _, pf := range pfs {
+		if p.vendor.MatchString(pf.Vendor) && p.selectors.Matches(pf) {
+			selected[hostID] = append(selected[hostID], *pf)
+		}
+	}
+	p.policy.PfSelector.Selected = &selected
+	p.policy.PfPlan = make(map[string]map[string]map[string]*host.Pf)
+	if err := p.policy.Plan(); err != nil {
+		return err
+	}
+	for i := range selected[hostID] {
+		current := &selected[hostID][i]
+		plan := p.policy.PfPlan[hostID][current.Address]
+		plan[host.PF_POLICY_CURRENT] = current
+		plan[host.PF_POLICY_PLANNED].NumVfs = p.plannedNumVfs(current)
+	}
+	return nil
+}
+
+// plannedNumVfs is the number of vfs a pf should end up with under the
+// policy, num_vfs = 0 removes the vfs
+func (p *sriovPolicy) plannedNumVfs(pf *host.Pf) int {
+	switch {
+	case pf.TotalVfs == 0:
+		// the pf is not vf capable
+		return pf.NumVfs
+	case p.policy.MaxVfs:
+		return pf.TotalVfs
+	case p.numVfs == nil:
+		return pf.NumVfs
+	case *p.numVfs > pf.TotalVfs:
+		return pf.TotalVfs
+	}
+	return *p.numVfs
+}
+
+// applyPfConfig applies a concrete pf config produced by the host policy
+// engine: the vf count first, then the vfio binding of the resulting vfs.
+func (d *VfDevicePlugin) applyPfConfig(ctx context.Context, pfConfig host.PfConfig, current *host.Pf) error {
+	if err := d.resizeNumVfs(ctx, current, pfConfig.NumVfs); err != nil {
+		return err
+	}
+	if !pfConfig.Vfio {
+		return nil
+	}
+	vfs, err := host.GetVfs()
+	if err != nil {
+		return err
+	}
+	for _, vf := range vfs.ByPfAddress(pfConfig.Address) {
+		if err := bindDriver(vf.Address, vfioPciDriver); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package vf
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/shared/hclspec"
+
+	"github.com/david-gurley/host"
+)
+
+const (
+	// attributes for pool device groups
+	PoolAttr     = "pool"
+	ProfileAttr  = "profile"
+	PoolModeAttr = "pool_mode"
+
+	// pool modes, what Reserve hands out for the vfs of a pool
+	poolModeVfio      = "vfio"
+	poolModeDpdk      = "dpdk"
+	poolModeNetdevice = "netdevice"
+)
+
+var (
+	poolNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+)
+
+// poolSpec is the hcl spec of the pool blocks
+func poolSpec() *hclspec.Spec {
+	return hclspec.NewBlockList("pool", hclspec.NewObject(map[string]*hclspec.Spec{
+		"name":        hclspec.NewAttr("name", "string", true),
+		"vfs":         hclspec.NewAttr("vfs", "string", false),
+		"driver":      hclspec.NewAttr("driver", "string", false),
+		"vendor":      hclspec.NewAttr("vendor", "string", false),
+		"type":        hclspec.NewAttr("type", "string", false),
+		"device_name": hclspec.NewAttr("device_name", "string", false),
+		"profile":     hclspec.NewAttr("profile", "string", false),
+		"mode":        hclspec.NewAttr("mode", "string", false),
+		"attributes":  hclspec.NewAttr("attributes", "map(string)", false),
+		"pf_selector": pfSelectorSpec(),
+	}))
+}
+
+// PoolConfig is a pool block. A pool claims the vfs with the given indexes
+// on every pf matched by its pf selectors, and advertises them as their own
+// device group, vendor/type/device_name, which defaults to generic/<name>/<name>.
+type PoolConfig struct {
+	Name        string             `codec:"name"`
+	Vfs         string             `codec:"vfs"`
+	Driver      string             `codec:"driver"`
+	Vendor      string             `codec:"vendor"`
+	Type        string             `codec:"type"`
+	DeviceName  string             `codec:"device_name"`
+	Profile     string             `codec:"profile"`
+	Mode        string             `codec:"mode"`
+	Attributes  map[string]string  `codec:"attributes"`
+	PfSelectors []PfSelectorConfig `codec:"pf_selector"`
+}
+
+// pool is a validated pool block
+type pool struct {
+	Name       string
+	Driver     string
+	Vendor     string
+	Type       string
+	DeviceName string
+	Profile    string
+	Mode       string
+	Attributes map[string]string
+	indexes    *indexSet
+	selectors  pfSelectors
+}
+
+// pools are matched in config order, the first pool claiming a vf wins
+type pools []*pool
+
+func newPools(configs []PoolConfig) (pools, error) {
+	ps := make(pools, 0, len(configs))
+	names := make(map[string]bool)
+	for i, c := range configs {
+		if !poolNamePattern.MatchString(c.Name) {
+			return nil, fmt.Errorf("pool %d: invalid name %q", i, c.Name)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("pool %d: duplicate name %q", i, c.Name)
+		}
+		names[c.Name] = true
+		indexes, err := parseIndexSet(c.Vfs)
+		if err != nil {
+			return nil, fmt.Errorf("pool %q: invalid vfs %q: %v", c.Name, c.Vfs, err)
+		}
+		selectors, err := newPfSelectors(c.PfSelectors)
+		if err != nil {
+			return nil, fmt.Errorf("pool %q: %v", c.Name, err)
+		}
+		mode, err := validatePoolMode(c.Mode, c.Profile)
+		if err != nil {
+			return nil, fmt.Errorf("pool %q: %v", c.Name, err)
+		}
+		if mode == poolModeNetdevice && c.Driver == vfioPciDriver {
+			return nil, fmt.Errorf("pool %q: mode %q keeps the vfs on their host driver, driver must not be %q", c.Name, mode, vfioPciDriver)
+		}
+		p := &pool{
+			Name:       c.Name,
+			Driver:     c.Driver,
+			Vendor:     c.Vendor,
+			Type:       c.Type,
+			DeviceName: c.DeviceName,
+			Profile:    c.Profile,
+			Mode:       mode,
+			Attributes: c.Attributes,
+			indexes:    indexes,
+			selectors:  selectors,
+		}
+		if p.Vendor == "" {
+			p.Vendor = vendor
+		}
+		if p.Type == "" {
+			p.Type = p.Name
+		}
+		if p.DeviceName == "" {
+			p.DeviceName = p.Name
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// validatePoolMode checks the mode of a pool, an empty mode is taken from the
+// profile when it names a mode and is vfio otherwise
+func validatePoolMode(mode string, profile string) (string, error) {
+	switch mode {
+	case "":
+		if profile == poolModeDpdk {
+			return poolModeDpdk, nil
+		}
+		return poolModeVfio, nil
+	case poolModeVfio, poolModeDpdk, poolModeNetdevice:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid mode %q, must be %q, %q or %q", mode, poolModeVfio, poolModeDpdk, poolModeNetdevice)
+}
+
+// vfsInMode returns the vfs of pools in the given mode
+func vfsInMode(vfs host.Vfs, vfPools map[string]*pool, mode string) host.Vfs {
+	selected := make(host.Vfs, 0)
+	for _, vf := range vfs {
+		if p := vfPools[vf.Address]; p != nil && p.Mode == mode {
+			selected = append(selected, vf)
+		}
+	}
+	return selected
+}
+
+// Claims reports whether the pool claims the vf with the given index on pf
+func (p *pool) Claims(pf *host.Pf, index int) bool {
+	return index >= 0 && p.indexes.Contains(index) && p.selectors.Matches(pf)
+}
+
+// Assign returns the pool claiming a vf, or nil if no pool does
+func (ps pools) Assign(pf *host.Pf, index int) *pool {
+	for _, p := range ps {
+		if p.Claims(pf, index) {
+			return p
+		}
+	}
+	return nil
+}
+
+// applyPools binds the vfs of every pool that sets a driver, and returns the
+// vfs of netdevice pools found on vfio-pci to their host driver. It runs once
+// at startup after the sriov policies so the pools see the provisioned vfs.
+func (d *VfDevicePlugin) applyPools() {
+	if len(d.pools) == 0 {
+		return
+	}
+	pfs, err := d.getPfs()
+	if err != nil {
+		d.logger.Error("failed to get pfs for pools", "error", err)
+		return
+	}
+	for _, pf := range pfs {
+		d.pciNames.resolvePf(pf)
+		for index, address := range vfAddresses(pf.Address) {
+			p := d.pools.Assign(pf, index)
+			if p == nil {
+				continue
+			}
+			if p.Driver == "" && p.Mode == poolModeNetdevice && pciDriver(address) == vfioPciDriver {
+				if err := bindDriver(address, ""); err != nil {
+					d.logger.Error("failed to restore host driver of pool vf", "pool", p.Name, "vf", address, "error", err)
+				}
+				continue
+			}
+			if p.Driver == "" {
+				continue
+			}
+			if err := bindDriver(address, p.Driver); err != nil {
+				d.logger.Error("failed to bind pool vf", "pool", p.Name, "vf", address, "driver", p.Driver, "error", err)
+			}
+		}
+	}
+}
+
+// indexSet is a set of vf indexes parsed from a list of ranges such as
+// "0-7,12". A nil set contains every index.
+type indexSet struct {
+	ranges [][2]int
+}
+
+func parseIndexSet(s string) (*indexSet, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	set := &indexSet{}
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		low, err := strconv.Atoi(bounds[0])
+		if err != nil || low < 0 {
+			return nil, fmt.Errorf("invalid index %q", part)
+		}
+		high := low
+		if len(bounds) == 2 {
+			high, err = strconv.Atoi(bounds[1])
+			if err != nil || high < low {
+				return nil, fmt.Errorf("invalid range %q", part)
+			}
+		}
+		set.ranges = append(set.ranges, [2]int{low, high})
+	}
+	sort.Slice(set.ranges, func(i, j int) bool { return set.ranges[i][0] < set.ranges[j][0] })
+	return set, nil
+}
+
+// Contains reports whether the index is part of the set
+func (s *indexSet) Contains(index int) bool {
+	if s == nil {
+		return true
+	}
+	for _, r := range s.ranges {
+		if index >= r[0] && index <= r[1] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package vf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/shared/structs"
+)
+
+const (
+	// attributes for device groups (host preflight checks)
+	IommuAttr                = "iommu"
+	IommuCmdlineAttr         = "iommu_cmdline"
+	VfioPciAttr              = "vfio_pci"
+	VfioIommuType1Attr       = "vfio_iommu_type1"
+	VfioDeviceAttr           = "vfio_device"
+	VfioUnsafeInterruptsAttr = "vfio_unsafe_interrupts"
+)
+
+// preflight checks that the host can hand out vfio devices: the iommu is
+// enabled, the vfio modules are loaded and the vfio container device exists.
+// The sysfs, procfs and devfs roots are fields so it can run against a fake
+// tree. host.GetKernelCmdline is a stub, so the command line is read here.
+type preflight struct {
+	sysRoot  string
+	procRoot string
+	devRoot  string
+}
+
+func newPreflight() *preflight {
+	return &preflight{
+		sysRoot:  sysfsRoot,
+		procRoot: "/proc",
+		devRoot:  "/dev",
+	}
+}
+
+// preflightResult is the outcome of the checks. failures is set when vfio
+// devices can not be opened, which only concerns the devices handed out
+// through vfio.
+type preflightResult struct {
+	attrs    map[string]*structs.Attribute
+	failures []string
+}
+
+// Desc is the health description of the failed checks
+func (r *preflightResult) Desc() string {
+	if len(r.failures) == 0 {
+		return ""
+	}
+	return "preflight failed: " + strings.Join(r.failures, ", ")
+}
+
+// Run runs every check
+func (p *preflight) Run() *preflightResult {
+	r := &preflightResult{attrs: make(map[string]*structs.Attribute)}
+
+	cmdline := p.iommuCmdline()
+	r.attrs[IommuCmdlineAttr] = &structs.Attribute{String: &cmdline}
+
+	iommu := p.iommuEnabled()
+	r.attrs[IommuAttr] = &structs.Attribute{Bool: &iommu}
+	if !iommu {
+		r.failures = append(r.failures, fmt.Sprintf("iommu is not enabled, no groups in %s (kernel command line %q)",
+			filepath.Join(p.sysRoot, "kernel", "iommu_groups"), cmdline))
+	}
+
+	for _, m := range []struct {
+		attr   string
+		module string
+	}{
+		{VfioPciAttr, "vfio_pci"},
+		{VfioIommuType1Attr, "vfio_iommu_type1"},
+	} {
+		loaded := p.moduleLoaded(m.module)
+		r.attrs[m.attr] = &structs.Attribute{Bool: &loaded}
+		if !loaded {
+			r.failures = append(r.failures, fmt.Sprintf("module %s not loaded", m.module))
+		}
+	}
+
+	device := p.vfioDevice()
+	r.attrs[VfioDeviceAttr] = &structs.Attribute{Bool: &device}
+	if !device {
+		r.failures = append(r.failures, fmt.Sprintf("%s missing", filepath.Join(p.devRoot, "vfio", "vfio")))
+	}
+
+	unsafe := p.unsafeInterrupts()
+	r.attrs[VfioUnsafeInterruptsAttr] = &structs.Attribute{Bool: &unsafe}
+	return r
+}
+
+// iommuCmdline returns the iommu related kernel parameters, e.g.
+// "intel_iommu=on iommu=pt"
+func (p *preflight) iommuCmdline() string {
+	b, err := ioutil.ReadFile(filepath.Join(p.procRoot, "cmdline"))
+	if err != nil {
+		return ""
+	}
+	params := make([]string, 0)
+	for _, param := range strings.Fields(string(b)) {
+		if strings.Contains(strings.SplitN(param, "=", 2)[0], "iommu") {
+			params = append(params, param)
+		}
+	}
+	return strings.Join(params, " ")
+}
+
+// iommuEnabled reports whether the kernel created iommu groups, which is the
+// case only when an iommu is present and enabled
+func (p *preflight) iommuEnabled() bool {
+	groups, err := ioutil.ReadDir(filepath.Join(p.sysRoot, "kernel", "iommu_groups"))
+	return err == nil && len(groups) != 0
+}
+
+// moduleLoaded reports whether a module is loaded or built in
+func (p *preflight) moduleLoaded(module string) bool {
+	_, err := os.Stat(filepath.Join(p.sysRoot, "module", module))
+	return err == nil
+}
+
+func (p *preflight) vfioDevice() bool {
+	_, err := os.Stat(filepath.Join(p.devRoot, "vfio", "vfio"))
+	return err == nil
+}
+
+// unsafeInterrupts reports whether vfio allows devices without interrupt
+// remapping, which weakens the isolation of the passed through devices
+func (p *preflight) unsafeInterrupts() bool {
+	b, err := ioutil.ReadFile(filepath.Join(p.sysRoot, "module", "vfio_iommu_type1", "parameters", "allow_unsafe_interrupts"))
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(b)) == "Y"
+}
+
+// runPreflight runs the preflight checks, logging when their outcome changes
+func (d *VfDevicePlugin) runPreflight() *preflightResult {
+	if d.preflight == nil {
+		return &preflightResult{}
+	}
+	r := d.preflight.Run()
+	status := r.Desc()
+	if status != d.preflightStatus {
+		if status == "" {
+			d.logger.Info("preflight checks passed")
+		} else {
+			d.logger.Warn("preflight checks failed, marking vfio devices unhealthy", "failures", strings.Join(r.failures, ", "))
+		}
+		d.preflightStatus = status
+	}
+	if unsafe := r.attrs[VfioUnsafeInterruptsAttr]; unsafe != nil && *unsafe.Bool && !d.warnedUnsafe {
+		d.logger.Warn("vfio allows unsafe interrupts, devices are not isolated by interrupt remapping")
+		d.warnedUnsafe = true
+	}
+	return r
+}
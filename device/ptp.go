@@ -0,0 +1,222 @@
+package vf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/hashicorp/nomad/plugins/device"
+	"github.com/hashicorp/nomad/plugins/shared/structs"
+	"golang.org/x/sys/unix"
+
+	"github.com/david-gurley/host"
+)
+
+const (
+	// attributes for device groups (pf timestamping)
+	PhcIndexAttr       = "pf_phc_index"
+	TimestampingAttr   = "pf_timestamping"
+	HwTimestampingAttr = "pf_hw_timestamping"
+	TsTxTypesAttr      = "pf_ts_tx_types"
+	TsRxFiltersAttr    = "pf_ts_rx_filters"
+)
+
+var (
+	// timestampingNames, txTypeNames and rxFilterNames name the bits of
+	// ethtool_ts_info like ethtool -T
+	timestampingNames = []string{
+		"hardware-transmit",
+		"software-transmit",
+		"hardware-receive",
+		"software-receive",
+		"software-system-clock",
+		"hardware-legacy-clock",
+		"hardware-raw-clock",
+	}
+	txTypeNames = []string{
+		"off",
+		"on",
+		"onestep-sync",
+		"onestep-p2p",
+	}
+	rxFilterNames = []string{
+		"none",
+		"all",
+		"some",
+		"ptpv1-l4-event",
+		"ptpv1-l4-sync",
+		"ptpv1-l4-delay-req",
+		"ptpv2-l4-event",
+		"ptpv2-l4-sync",
+		"ptpv2-l4-delay-req",
+		"ptpv2-l2-event",
+		"ptpv2-l2-sync",
+		"ptpv2-l2-delay-req",
+		"ptpv2-event",
+		"ptpv2-sync",
+		"ptpv2-delay-req",
+		"ntp-all",
+	}
+
+	// hwTimestamping are the modes needed for hardware timestamping
+	hwTimestamping = uint32(unix.SOF_TIMESTAMPING_TX_HARDWARE | unix.SOF_TIMESTAMPING_RX_HARDWARE | unix.SOF_TIMESTAMPING_RAW_HARDWARE)
+)
+
+// ethtoolTsInfo is struct ethtool_ts_info
+type ethtoolTsInfo struct {
+	cmd            uint32
+	soTimestamping uint32
+	phcIndex       int32
+	txTypes        uint32
+	txReserved     [3]uint32
+	rxFilters      uint32
+	rxReserved     [3]uint32
+}
+
+// ethtoolIfreq is struct ifreq with ifr_data, padded to the size of the
+// kernel union. data is an unsafe.Pointer so the garbage collector keeps
+// track of the struct it points to.
+type ethtoolIfreq struct {
+	name [unix.IFNAMSIZ]byte
+	data unsafe.Pointer
+	_    [16]byte
+}
+
+// ptpInfo is the timestamping capability of a pf
+type ptpInfo struct {
+	// PhcIndex is the index of the ptp hardware clock, /dev/ptp<index>, or
+	// -1 when the pf has none
+	PhcIndex     int
+	Timestamping uint32
+	TxTypes      uint32
+	RxFilters    uint32
+}
+
+// readTsInfo queries the ethtool timestamping info of an interface
+func readTsInfo(interfaceName string) (*ptpInfo, error) {
+	if len(interfaceName) >= unix.IFNAMSIZ {
+		return nil, fmt.Errorf("invalid interface name %q", interfaceName)
+	}
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+	info := ethtoolTsInfo{cmd: unix.ETHTOOL_GET_TS_INFO}
+	ifr := ethtoolIfreq{data: unsafe.Pointer(&info)}
+	copy(ifr.name[:], interfaceName)
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCETHTOOL, uintptr(unsafe.Pointer(&ifr)))
+	runtime.KeepAlive(&ifr)
+	runtime.KeepAlive(&info)
+	if errno != 0 {
+		return nil, errno
+	}
+	return &ptpInfo{
+		PhcIndex:     int(info.phcIndex),
+		Timestamping: info.soTimestamping,
+		TxTypes:      info.txTypes,
+		RxFilters:    info.rxFilters,
+	}, nil
+}
+
+// sysfsPhcIndex returns the index of the ptp clock a pci device registered,
+// from /sys/bus/pci/devices/<addr>/ptp, or -1
+func sysfsPhcIndex(address string) int {
+	entries, err := ioutil.ReadDir(pciDevicePath(address, "ptp"))
+	if err != nil {
+		return -1
+	}
+	for _, e := range entries {
+		if index, err := strconv.Atoi(strings.TrimPrefix(e.Name(), "ptp")); err == nil {
+			return index
+		}
+	}
+	return -1
+}
+
+// readPtpInfos reads the timestamping capability of every pf. Pfs without an
+// interface only get the clock they registered in sysfs.
+func readPtpInfos(pfsMap map[string]*host.Pf) map[string]*ptpInfo {
+	infos := make(map[string]*ptpInfo)
+	for address, pf := range pfsMap {
+		info := &ptpInfo{PhcIndex: -1}
+		if pf.InterfaceName != "" {
+			if i, err := readTsInfo(pf.InterfaceName); err == nil {
+				info = i
+			}
+		}
+		if info.PhcIndex < 0 {
+			info.PhcIndex = sysfsPhcIndex(address)
+		}
+		if info.PhcIndex < 0 && info.Timestamping == 0 {
+			continue
+		}
+		infos[address] = info
+	}
+	return infos
+}
+
+// Device returns the ptp clock device of the pf, or an empty string
+func (p *ptpInfo) Device() string {
+	if p == nil || p.PhcIndex < 0 {
+		return ""
+	}
+	return filepath.Join("/dev", fmt.Sprintf("ptp%d", p.PhcIndex))
+}
+
+// bitNames lists the names of the bits set in flags
+func bitNames(flags uint32, names []string) string {
+	set := make([]string, 0)
+	for i, name := range names {
+		if flags&(1<<uint(i)) != 0 {
+			set = append(set, name)
+		}
+	}
+	return strings.Join(set, ",")
+}
+
+// attributes adds the timestamping capability of a pf to the attributes of
+// a device group
+func (p *ptpInfo) attributes(attrs map[string]*structs.Attribute) {
+	if p == nil {
+		return
+	}
+	if p.PhcIndex >= 0 {
+		attrs[PhcIndexAttr] = structs.NewIntAttribute(int64(p.PhcIndex), "")
+	}
+	hw := p.Timestamping&hwTimestamping == hwTimestamping
+	attrs[HwTimestampingAttr] = &structs.Attribute{Bool: &hw}
+	for attr, value := range map[string]string{
+		TimestampingAttr: bitNames(p.Timestamping, timestampingNames),
+		TsTxTypesAttr:    bitNames(p.TxTypes, txTypeNames),
+		TsRxFiltersAttr:  bitNames(p.RxFilters, rxFilterNames),
+	} {
+		value := value
+		if value != "" {
+			attrs[attr] = &structs.Attribute{String: &value}
+		}
+	}
+}
+
+// ptpDevices returns the ptp clocks of the pfs of the reserved vfs
+func ptpDevices(vfs host.Vfs, infos map[string]*ptpInfo) []*device.DeviceSpec {
+	specs := make([]*device.DeviceSpec, 0)
+	seen := make(map[string]bool)
+	for _, vf := range vfs {
+		dev := infos[vf.PfAddress].Device()
+		if dev == "" || seen[dev] {
+			continue
+		}
+		seen[dev] = true
+		specs = append(specs, &device.DeviceSpec{
+			TaskPath:    dev,
+			HostPath:    dev,
+			CgroupPerms: "rw",
+		})
+	}
+	return specs
+}
@@ -0,0 +1,102 @@
+package vf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/nomad/plugins/device"
+	"github.com/hashicorp/nomad/plugins/shared/structs"
+
+	"github.com/david-gurley/host"
+)
+
+const (
+	// attributes for device groups (rdma)
+	RdmaAttr = "rdma"
+
+	// rdmaDeviceEnv and uverbsEnv prefix the environment variables holding
+	// the rdma device and verbs device of every reserved vf, indexed like
+	// DEVICE_VF_<vendor>_<i>
+	rdmaDeviceEnv = "VF_RDMA_DEVICE_"
+	uverbsEnv     = "VF_UVERBS_"
+)
+
+// rdmaDevice is the rdma device of a pci function
+type rdmaDevice struct {
+	// Name is the rdma device name, e.g. mlx5_3
+	Name string
+	// Uverbs is the verbs character device, e.g. uverbs3
+	Uverbs string
+}
+
+// readRdmaDevice returns the rdma device a pci function registered, or nil.
+// Functions bound to vfio-pci have none.
+func readRdmaDevice(address string) *rdmaDevice {
+	name := firstEntry(pciDevicePath(address, "infiniband"))
+	if name == "" {
+		return nil
+	}
+	return &rdmaDevice{
+		Name:   name,
+		Uverbs: firstEntry(pciDevicePath(address, "infiniband_verbs")),
+	}
+}
+
+// firstEntry returns the name of the first entry of a directory, or an empty
+// string
+func firstEntry(dir string) string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil || len(entries) == 0 {
+		return ""
+	}
+	return entries[0].Name()
+}
+
+// rdmaAttributes adds whether every device of a group has an rdma device
+func rdmaAttributes(vfs host.Vfs, attrs map[string]*structs.Attribute) {
+	rdma := true
+	for _, vf := range vfs {
+		if readRdmaDevice(vf.Address) == nil {
+			rdma = false
+			break
+		}
+	}
+	attrs[RdmaAttr] = &structs.Attribute{Bool: &rdma}
+}
+
+// rdmaReservation returns the verbs devices of the reserved vfs, the rdma_cm
+// device when there is any, and the rdma device names in the env
+func rdmaReservation(vfs host.Vfs) ([]*device.DeviceSpec, map[string]string) {
+	specs := make([]*device.DeviceSpec, 0)
+	envs := make(map[string]string)
+	for i, vf := range vfs {
+		rdma := readRdmaDevice(vf.Address)
+		if rdma == nil {
+			continue
+		}
+		envs[fmt.Sprintf("%s%d", rdmaDeviceEnv, i)] = rdma.Name
+		if rdma.Uverbs == "" {
+			continue
+		}
+		envs[fmt.Sprintf("%s%d", uverbsEnv, i)] = rdma.Uverbs
+		specs = append(specs, infinibandDevice(rdma.Uverbs))
+	}
+	if len(specs) != 0 {
+		if _, err := os.Stat(filepath.Join("/dev", "infiniband", "rdma_cm")); err == nil {
+			specs = append(specs, infinibandDevice("rdma_cm"))
+		}
+	}
+	return specs, envs
+}
+
+// infinibandDevice is a device under /dev/infiniband
+func infinibandDevice(name string) *device.DeviceSpec {
+	path := filepath.Join("/dev", "infiniband", name)
+	return &device.DeviceSpec{
+		TaskPath:    path,
+		HostPath:    path,
+		CgroupPerms: "rw",
+	}
+}
@@ -0,0 +1,157 @@
+package vf
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/david-gurley/host"
+)
+
+const (
+	// manifestEnv is the environment variable holding the json reservation
+	// manifest
+	manifestEnv = "VF_MANIFEST"
+
+	// reservationGracePeriod is how long a reservation is considered active
+	// before the task has opened the device
+	reservationGracePeriod = 5 * time.Minute
+)
+
+// reservation tracks a device handed out by Reserve. Nomad does not tell
+// device plugins when a device is released, so a reservation ends once the
+// vfio group is no longer held, or when it was never opened within the grace
+// period.
+type reservation struct {
+	ID        string
+	Address   string
+	PfAddress string
+	Reserved  time.Time
+	Held      bool
+	// Netdevice is set for vfs of netdevice pools, which are held while
+	// their netdev is moved out of the host network namespace
+	Netdevice bool
+	// IrqAffinity is the affinity of the vf irqs before they were pinned
+	IrqAffinity map[int]string
+}
+
+// recordReservations remembers the devices handed out by Reserve, keyed by
+// device id
+func (d *VfDevicePlugin) recordReservations(vfs host.Vfs, ids map[string]string, vfPools map[string]*pool) {
+	d.reservationLock.Lock()
+	defer d.reservationLock.Unlock()
+	now := time.Now()
+	for _, vf := range vfs {
+		id := deviceID(vf, ids)
+		d.reservations[id] = &reservation{
+			ID:        id,
+			Address:   vf.Address,
+			PfAddress: vf.PfAddress,
+			Reserved:  now,
+		}
+		if p := vfPools[vf.Address]; p != nil && p.Mode == poolModeNetdevice {
+			d.reservations[id].Netdevice = true
+		}
+	}
+}
+
+// pruneReservations updates the reservations with the current vfio
+// allocations and drops the ones that have been released
+func (d *VfDevicePlugin) pruneReservations(allocations []string) {
+	d.reservationLock.Lock()
+	defer d.reservationLock.Unlock()
+	for id, r := range d.reservations {
+		held := host.IsAllocated(allocations, host.IommuGroup(r.Address))
+		if r.Netdevice {
+			held = netdeviceHeld(r.Address)
+		}
+		switch {
+		case held:
+			r.Held = true
+		case r.Held, time.Since(r.Reserved) > reservationGracePeriod:
+			d.logger.Debug("reservation released", "device", id)
+			d.restoreIrqs(r)
+			if r.Netdevice {
+				os.Remove(cniConfigPath(d.cniDir, id))
+			}
+			delete(d.reservations, id)
+		}
+	}
+}
+
+// reservedAddresses returns the addresses of the reserved vfs of a pf
+func (d *VfDevicePlugin) reservedAddresses(pfAddress string) []string {
+	d.reservationLock.RLock()
+	defer d.reservationLock.RUnlock()
+	addresses := make([]string, 0)
+	for _, r := range d.reservations {
+		if r.PfAddress == pfAddress {
+			addresses = append(addresses, r.Address)
+		}
+	}
+	return addresses
+}
+
+// reservationManifest describes the reserved devices to the task
+type reservationManifest struct {
+	Devices []*manifestDevice `json:"devices"`
+}
+
+type manifestDevice struct {
+	ID          string            `json:"id"`
+	Address     string            `json:"address"`
+	PfAddress   string            `json:"pf_address"`
+	PfInterface string            `json:"pf_interface,omitempty"`
+	Vendor      string            `json:"vendor"`
+	VendorID    string            `json:"vendor_id"`
+	Device      string            `json:"device"`
+	DeviceID    string            `json:"device_id"`
+	IommuGroup  string            `json:"iommu_group"`
+	NumaNode    int               `json:"numa_node"`
+	LocalCpus   string            `json:"local_cpulist,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Bundle      string            `json:"bundle,omitempty"`
+	Representor string            `json:"representor,omitempty"`
+	PtpDevice   string            `json:"ptp_device,omitempty"`
+	RdmaDevice  string            `json:"rdma_device,omitempty"`
+	Uverbs      string            `json:"uverbs,omitempty"`
+}
+
+// reservationManifest builds the json manifest of the reserved vfs, bundles
+// maps the address of bundled vfs to their bundle
+func (d *VfDevicePlugin) reservationManifest(vfs host.Vfs, ids map[string]string, pfs map[string]*host.Pf, bundles map[string]string, representors map[string]string, ptp map[string]*ptpInfo) (string, error) {
+	manifest := &reservationManifest{
+		Devices: make([]*manifestDevice, 0, len(vfs)),
+	}
+	for _, vf := range vfs {
+		m := &manifestDevice{
+			ID:          deviceID(vf, ids),
+			Address:     vf.Address,
+			PfAddress:   vf.PfAddress,
+			Vendor:      vf.Vendor,
+			VendorID:    vf.VendorID,
+			Device:      vf.Device,
+			DeviceID:    vf.DeviceID,
+			IommuGroup:  vf.IommuGroup,
+			NumaNode:    numaNode(vf.Address),
+			LocalCpus:   localCpulist(vf.Address),
+			Bundle:      bundles[vf.Address],
+			Representor: representors[vf.Address],
+			PtpDevice:   ptp[vf.PfAddress].Device(),
+		}
+		if rdma := readRdmaDevice(vf.Address); rdma != nil {
+			m.RdmaDevice = rdma.Name
+			m.Uverbs = rdma.Uverbs
+		}
+		if pf := pfs[vf.PfAddress]; pf != nil {
+			m.PfInterface = pf.InterfaceName
+			m.Labels = d.pfLabels.For(pf)
+		}
+		manifest.Devices = append(manifest.Devices, m)
+	}
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
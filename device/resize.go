@@ -0,0 +1,226 @@
+package vf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/david-gurley/host"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	resizeInUseRefuse = "refuse"
+	resizeInUseWait   = "wait"
+
+	// resizeSettleTime is how long the kernel gets to create the vfs
+	resizeSettleTime = 10 * time.Second
+)
+
+type resizeInUseError struct {
+	pfAddress string
+	inUse     []string
+}
+
+func (e *resizeInUseError) Error() string {
+	return fmt.Sprintf("cannot resize vfs of pf %s, vfs in use: %s", e.pfAddress, strings.Join(e.inUse, ","))
+}
+
+// vfConfig is the per-vf configuration that is lost when sriov_numvfs is
+// reset and has to be restored on rollback
+type vfConfig struct {
+	Address  string
+	Driver   string
+	Mac      net.HardwareAddr
+	Vlan     int
+	Spoofchk bool
+}
+
+// resizeNumVfs changes the number of vfs of a pf. The kernel destroys every
+// vf when sriov_numvfs changes, so the resize fails with a resizeInUseError
+// while any vf of the pf is reserved, held open through vfio or moved into a
+// task. A non-zero count is always reset to 0 first. If the new count does
+// not apply, the previous count and the per-vf config are restored.
+func (d *VfDevicePlugin) resizeNumVfs(ctx context.Context, pf *host.Pf, num int) error {
+	current, err := host.ReadFileInt(pciDevicePath(pf.Address, "sriov_numvfs"))
+	if err != nil {
+		return err
+	}
+	if current == num {
+		return nil
+	}
+	if err := d.checkVfsIdle(pf); err != nil {
+		return err
+	}
+	snapshot := snapshotVfConfig(pf)
+
+	err = setNumVfs(ctx, pf.Address, current, num)
+	if err == nil {
+		d.logger.Info("resized vfs", "pf", pf.Address, "num_vfs", fmt.Sprintf("%d -> %d", current, num))
+		return nil
+	}
+	d.logger.Error("failed to resize vfs, restoring previous vfs", "pf", pf.Address, "num_vfs", num, "error", err)
+	if rerr := setNumVfs(ctx, pf.Address, -1, current); rerr != nil {
+		return fmt.Errorf("failed to resize vfs of pf %s: %v, rollback failed: %v", pf.Address, err, rerr)
+	}
+	if rerr := restoreVfConfig(pf, snapshot); rerr != nil {
+		return fmt.Errorf("failed to resize vfs of pf %s: %v, restoring vf config failed: %v", pf.Address, err, rerr)
+	}
+	return fmt.Errorf("failed to resize vfs of pf %s, restored %d vfs: %v", pf.Address, current, err)
+}
+
+// checkVfsIdle returns a resizeInUseError when a vf of the pf is reserved,
+// held through vfio or moved into a task. It never waits, a "wait" resize is
+// retried on later fingerprints instead, see retryDeferredPfConfigs.
+func (d *VfDevicePlugin) checkVfsIdle(pf *host.Pf) error {
+	inUse, err := d.vfsInUse(pf)
+	if err != nil {
+		return err
+	}
+	if len(inUse) != 0 {
+		return &resizeInUseError{pf.Address, inUse}
+	}
+	return nil
+}
+
+// vfsInUse lists the vfs of a pf that are reserved, held by a vfio user or,
+// in netdevice pools, whose netdev was moved out of the host network
+// namespace. The reservations only cover Reserve calls since the plugin
+// started and are empty when the sriov policies run at startup, so tasks that
+// survived a plugin restart are only detected through their open vfio groups
+// and moved netdevs. Other use of a vf bound to a host driver, e.g. rdma on a
+// netdev left in the host, is not detected.
+func (d *VfDevicePlugin) vfsInUse(pf *host.Pf) ([]string, error) {
+	allocations, err := host.VfioAllocations()
+	if err != nil {
+		return nil, err
+	}
+	inUse := make(map[string]bool)
+	for _, address := range d.reservedAddresses(pf.Address) {
+		inUse[address] = true
+	}
+	for index, address := range vfAddresses(pf.Address) {
+		if host.IsAllocated(allocations, host.IommuGroup(address)) {
+			inUse[address] = true
+		}
+		// vfs of other pools may sit on a driver without a netdev for good
+		if p := d.pools.Assign(pf, index); p != nil && p.Mode == poolModeNetdevice && netdeviceHeld(address) {
+			inUse[address] = true
+		}
+	}
+	addresses := make([]string, 0, len(inUse))
+	for address := range inUse {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+// setNumVfs writes sriov_numvfs, stepping through 0 when both the current
+// and the new count are non-zero, and verifies the resulting vfs. A negative
+// current count forces the reset to 0.
+func setNumVfs(ctx context.Context, pfAddress string, current int, num int) error {
+	if current != 0 && num != 0 {
+		if err := host.SetNumVfs(pfAddress, 0); err != nil {
+			return err
+		}
+		if err := verifyNumVfs(ctx, pfAddress, 0); err != nil {
+			return err
+		}
+	}
+	if err := host.SetNumVfs(pfAddress, num); err != nil {
+		return err
+	}
+	return verifyNumVfs(ctx, pfAddress, num)
+}
+
+// verifyNumVfs waits for sriov_numvfs and the virtfn links of a pf to match
+// the expected count
+func verifyNumVfs(ctx context.Context, pfAddress string, num int) error {
+	deadline := time.Now().Add(resizeSettleTime)
+	for {
+		numVfs, err := host.ReadFileInt(pciDevicePath(pfAddress, "sriov_numvfs"))
+		if err != nil {
+			return err
+		}
+		links := len(vfAddresses(pfAddress))
+		if numVfs == num && links == num {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("pf %s has %d vfs (%d present), expected %d", pfAddress, numVfs, links, num)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// snapshotVfConfig records the driver binding and the netlink vf settings of
+// every vf of a pf
+func snapshotVfConfig(pf *host.Pf) map[int]*vfConfig {
+	snapshot := make(map[int]*vfConfig)
+	for index, address := range vfAddresses(pf.Address) {
+		snapshot[index] = &vfConfig{
+			Address: address,
+			Driver:  pciDriver(address),
+		}
+	}
+	if pf.InterfaceName == "" {
+		return snapshot
+	}
+	link, err := netlink.LinkByName(pf.InterfaceName)
+	if err != nil {
+		return snapshot
+	}
+	for _, info := range link.Attrs().Vfs {
+		if c, ok := snapshot[info.ID]; ok {
+			c.Mac = info.Mac
+			c.Vlan = info.Vlan
+			c.Spoofchk = info.Spoofchk
+		}
+	}
+	return snapshot
+}
+
+// restoreVfConfig re-applies a snapshot taken by snapshotVfConfig
+func restoreVfConfig(pf *host.Pf, snapshot map[int]*vfConfig) error {
+	var link netlink.Link
+	if pf.InterfaceName != "" {
+		l, err := netlink.LinkByName(pf.InterfaceName)
+		if err != nil {
+			return err
+		}
+		link = l
+	}
+	errs := make([]string, 0)
+	for index, c := range snapshot {
+		if link != nil {
+			if len(c.Mac) != 0 {
+				if err := netlink.LinkSetVfHardwareAddr(link, index, c.Mac); err != nil {
+					errs = append(errs, fmt.Sprintf("vf %d mac: %v", index, err))
+				}
+			}
+			if err := netlink.LinkSetVfVlan(link, index, c.Vlan); err != nil {
+				errs = append(errs, fmt.Sprintf("vf %d vlan: %v", index, err))
+			}
+			if err := netlink.LinkSetVfSpoofchk(link, index, c.Spoofchk); err != nil {
+				errs = append(errs, fmt.Sprintf("vf %d spoofchk: %v", index, err))
+			}
+		}
+		if c.Driver != "" {
+			if err := bindDriver(c.Address, c.Driver); err != nil {
+				errs = append(errs, fmt.Sprintf("vf %d driver: %v", index, err))
+			}
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
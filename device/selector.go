@@ -0,0 +1,219 @@
+package vf
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/shared/hclspec"
+
+	"github.com/david-gurley/host"
+)
+
+const (
+	selectorMatchAll = "all"
+	selectorMatchAny = "any"
+)
+
+var (
+	pciIDPattern = regexp.MustCompile(`^[0-9a-f*?]{1,4}:[0-9a-f*?]{1,4}$`)
+)
+
+// pfSelectorSpec is the hcl spec of a pf_selector block. It is used both at
+// the top level of the config to filter advertised devices by their pf, and
+// inside sriov_policy blocks to pick the pfs to provision.
+func pfSelectorSpec() *hclspec.Spec {
+	return hclspec.NewBlockList("pf_selector", hclspec.NewObject(map[string]*hclspec.Spec{
+		"match": hclspec.NewDefault(
+			hclspec.NewAttr("match", "string", false),
+			hclspec.NewLiteral("\"all\""),
+		),
+		"vendor_regexp": hclspec.NewAttr("vendor_regexp", "string", false),
+		"driver":        hclspec.NewAttr("driver", "string", false),
+		"pci_id":        hclspec.NewAttr("pci_id", "string", false),
+		"address":       hclspec.NewAttr("address", "string", false),
+		"interface":     hclspec.NewAttr("interface", "string", false),
+		"numa_node": hclspec.NewDefault(
+			hclspec.NewAttr("numa_node", "number", false),
+			hclspec.NewLiteral("-1"),
+		),
+		"min_link_speed": hclspec.NewAttr("min_link_speed", "number", false),
+		"no_host_ip":     hclspec.NewAttr("no_host_ip", "bool", false),
+	}))
+}
+
+// PfSelectorConfig is a pf_selector block. The criteria that are set are
+// combined with AND when match is "all" and with OR when match is "any".
+// Several pf_selector blocks are combined with OR.
+type PfSelectorConfig struct {
+	Match        string `codec:"match"`
+	VendorRegexp string `codec:"vendor_regexp"`
+	Driver       string `codec:"driver"`
+	PciID        string `codec:"pci_id"`
+	Address      string `codec:"address"`
+	Interface    string `codec:"interface"`
+	NumaNode     int    `codec:"numa_node"`
+	MinLinkSpeed int    `codec:"min_link_speed"`
+	NoHostIP     bool   `codec:"no_host_ip"`
+}
+
+// pfCriterion reports whether a single selector criterion matches a pf
+type pfCriterion func(pf *host.Pf) bool
+
+type pfSelector struct {
+	any      bool
+	criteria []pfCriterion
+}
+
+// pfSelectors is a list of pf selectors that matches a pf when any of the
+// selectors matches. An empty list matches every pf.
+type pfSelectors []*pfSelector
+
+func newPfSelectors(configs []PfSelectorConfig) (pfSelectors, error) {
+	selectors := make(pfSelectors, 0, len(configs))
+	for i, c := range configs {
+		s, err := newPfSelector(c)
+		if err != nil {
+			return nil, fmt.Errorf("pf_selector %d: %v", i, err)
+		}
+		selectors = append(selectors, s)
+	}
+	return selectors, nil
+}
+
+func newPfSelector(c PfSelectorConfig) (*pfSelector, error) {
+	var s pfSelector
+	switch c.Match {
+	case selectorMatchAll, "":
+	case selectorMatchAny:
+		s.any = true
+	default:
+		return nil, fmt.Errorf("invalid match %q, must be %q or %q", c.Match, selectorMatchAll, selectorMatchAny)
+	}
+	if c.VendorRegexp != "" {
+		r, err := regexp.Compile(c.VendorRegexp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vendor_regexp %q: %v", c.VendorRegexp, err)
+		}
+		s.criteria = append(s.criteria, func(pf *host.Pf) bool {
+			return r.MatchString(pf.Vendor)
+		})
+	}
+	if c.Driver != "" {
+		s.criteria = append(s.criteria, func(pf *host.Pf) bool {
+			return pf.Driver == c.Driver
+		})
+	}
+	if c.PciID != "" {
+		pciID := strings.ToLower(c.PciID)
+		if !pciIDPattern.MatchString(pciID) {
+			return nil, fmt.Errorf("invalid pci_id %q, must be vendor:device, e.g. 15b3:1017", c.PciID)
+		}
+		ids := strings.SplitN(pciID, ":", 2)
+		s.criteria = append(s.criteria, func(pf *host.Pf) bool {
+			return globMatch(ids[0], trimHexID(pf.VendorID)) && globMatch(ids[1], trimHexID(pf.DeviceID))
+		})
+	}
+	if c.Address != "" {
+		if err := validateGlob(c.Address); err != nil {
+			return nil, fmt.Errorf("invalid address %q: %v", c.Address, err)
+		}
+		s.criteria = append(s.criteria, func(pf *host.Pf) bool {
+			return globMatch(strings.ToLower(c.Address), pf.Address)
+		})
+	}
+	if c.Interface != "" {
+		if err := validateGlob(c.Interface); err != nil {
+			return nil, fmt.Errorf("invalid interface %q: %v", c.Interface, err)
+		}
+		s.criteria = append(s.criteria, func(pf *host.Pf) bool {
+			return pf.InterfaceName != "" && globMatch(c.Interface, pf.InterfaceName)
+		})
+	}
+	if c.NumaNode >= 0 {
+		s.criteria = append(s.criteria, func(pf *host.Pf) bool {
+			return numaNode(pf.Address) == c.NumaNode
+		})
+	}
+	if c.MinLinkSpeed > 0 {
+		s.criteria = append(s.criteria, func(pf *host.Pf) bool {
+			return linkSpeed(pf.InterfaceName) >= c.MinLinkSpeed
+		})
+	}
+	if c.NoHostIP {
+		s.criteria = append(s.criteria, func(pf *host.Pf) bool {
+			return !pf.HasIPAddress
+		})
+	}
+	if len(s.criteria) == 0 {
+		return nil, fmt.Errorf("at least one selection criterion is required")
+	}
+	return &s, nil
+}
+
+// Matches reports whether the pf matches the selector
+func (s *pfSelector) Matches(pf *host.Pf) bool {
+	for _, criterion := range s.criteria {
+		if criterion(pf) == s.any {
+			return s.any
+		}
+	}
+	return !s.any
+}
+
+// Matches reports whether any selector matches the pf
+func (selectors pfSelectors) Matches(pf *host.Pf) bool {
+	if len(selectors) == 0 {
+		return true
+	}
+	if pf == nil {
+		return false
+	}
+	for _, s := range selectors {
+		if s.Matches(pf) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateGlob checks that a pattern can be used with globMatch
+func validateGlob(pattern string) error {
+	_, err := path.Match(pattern, "")
+	return err
+}
+
+// globMatch reports whether the name matches the shell pattern
+func globMatch(pattern string, name string) bool {
+	match, err := path.Match(pattern, name)
+	return err == nil && match
+}
+
+// trimHexID normalizes a sysfs hex id such as 0x15B3 to 15b3
+func trimHexID(id string) string {
+	return strings.TrimPrefix(strings.ToLower(id), "0x")
+}
+
+// numaNode returns the numa node of a pci device, or -1 when unknown
+func numaNode(address string) int {
+	node, err := host.ReadFileInt(pciDevicePath(address, "numa_node"))
+	if err != nil {
+		return -1
+	}
+	return node
+}
+
+// linkSpeed returns the link speed of an interface in Mb/s, or -1 when the
+// link is down or the interface unknown
+func linkSpeed(interfaceName string) int {
+	if interfaceName == "" {
+		return -1
+	}
+	speed, err := host.ReadFileInt(filepath.Join(sysfsRoot, "class", "net", interfaceName, "speed"))
+	if err != nil {
+		return -1
+	}
+	return speed
+}
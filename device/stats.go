@@ -40,56 +40,33 @@ type deviceStats struct {
 // device groups, and sends the data over the provided channel.
 func (d *VfDevicePlugin) writeStatsToChannel(stats chan<- *device.StatsResponse, timestamp time.Time) {
 
-	pfsMap, err := host.GetPfsMap()
-	if err != nil {
-		d.logger.Error("error getting pfs map", "error", err)
-	}
-	deviceGroupNames := make(map[string]GroupMapping)
-	for _, vf := range d.devices {
-		deviceGroupNames[vf.PfAddress] = GroupMapping{
-			Devices: append(deviceGroupNames[vf.PfAddress].Devices, vf),
-			Vendor:  vf.Vendor,
-			Type:    "vf",
-		}
-	}
+	d.deviceLock.RLock()
+	pfsMap := d.pfs
+	groups := d.groups
+	ids := d.ids
+	d.deviceLock.RUnlock()
+
+	pfDeviceStats := make(map[string]*device.DeviceStats)
 	deviceGroupStats := make([]*device.DeviceGroupStats, 0)
-	for groupName, groupMapping := range deviceGroupNames {
-		pfStats, err := pfsMap[groupName].Stats()
-		if err != nil {
-			continue
-		}
-		txBytes := pfStats["tx_bytes"]
-		rxBytes := pfStats["rx_byptes"]
-		deviceStats := &device.DeviceStats{
-			Summary: &structs.StatValue{
-				Desc:            "Tx Bytes",
-				IntNumeratorVal: uint64ToInt64Ptr(&txBytes),
-				Unit:            "Bytes",
-			},
-			Stats: &structs.StatObject{
-				Attributes: map[string]*structs.StatValue{
-					"tx_bytes": &structs.StatValue{
-						Desc:            "Tx Bytes",
-						IntNumeratorVal: uint64ToInt64Ptr(&txBytes),
-						Unit:            "Bytes",
-					},
-					"rx_bytes": &structs.StatValue{
-						Desc:            "Rx Bytes",
-						IntNumeratorVal: uint64ToInt64Ptr(&rxBytes),
-						Unit:            "Bytes",
-					},
-				},
-			},
-			Timestamp: time.Now(),
-		}
+	for _, groupMapping := range groups {
 		instanceStats := make(map[string]*device.DeviceStats)
-		for _, vf := range groupMapping.Devices {
-			instanceStats[vf.Address] = deviceStats
+		for _, instance := range groupMapping.Instances(ids) {
+			// bundles report the stats of their first vf
+			vf := instance.Devices[0]
+			deviceStats, ok := pfDeviceStats[vf.PfAddress]
+			if !ok {
+				deviceStats = pfStats(pfsMap[vf.PfAddress], d.classes.Netdev(vf.Address), timestamp)
+				pfDeviceStats[vf.PfAddress] = deviceStats
+			}
+			if deviceStats == nil {
+				continue
+			}
+			instanceStats[instance.ID] = vfStats(vf, deviceStats)
 		}
 		deviceGroupStats = append(deviceGroupStats, &device.DeviceGroupStats{
 			Vendor:        groupMapping.Vendor,
 			Type:          groupMapping.Type,
-			Name:          groupName,
+			Name:          groupMapping.Name,
 			InstanceStats: instanceStats,
 		})
 	}
@@ -99,6 +76,84 @@ func (d *VfDevicePlugin) writeStatsToChannel(stats chan<- *device.StatsResponse,
 	}
 }
 
+// vfStats adds the aer counters of a vf to a copy of the stats of its pf
+func vfStats(vf *host.Vf, pfStats *device.DeviceStats) *device.DeviceStats {
+	attrs := make(map[string]*structs.StatValue, len(pfStats.Stats.Attributes)+len(aerFiles))
+	for k, v := range pfStats.Stats.Attributes {
+		attrs[k] = v
+	}
+	readAerCounters(vf.Address).statAttributes(attrs, "")
+	return &device.DeviceStats{
+		Summary:   pfStats.Summary,
+		Stats:     &structs.StatObject{Attributes: attrs},
+		Timestamp: pfStats.Timestamp,
+	}
+}
+
+// pfStats collects the ethtool stats of a pf, which are reported for each of
+// its vfs. Without netdev only the aer counters of the pf are reported.
+func pfStats(pf *host.Pf, netdev bool, timestamp time.Time) *device.DeviceStats {
+	if pf == nil {
+		return nil
+	}
+	if !netdev || pf.InterfaceName == "" {
+		return pfAerStats(pf, timestamp)
+	}
+	pfStats, err := pf.Stats()
+	if err != nil {
+		return nil
+	}
+	txBytes := pfStats["tx_bytes"]
+	rxBytes := pfStats["rx_bytes"]
+	deviceStats := &device.DeviceStats{
+		Summary: &structs.StatValue{
+			Desc:            "Tx Bytes",
+			IntNumeratorVal: uint64ToInt64Ptr(&txBytes),
+			Unit:            "Bytes",
+		},
+		Stats: &structs.StatObject{
+			Attributes: map[string]*structs.StatValue{
+				"tx_bytes": &structs.StatValue{
+					Desc:            "Tx Bytes",
+					IntNumeratorVal: uint64ToInt64Ptr(&txBytes),
+					Unit:            "Bytes",
+				},
+				"rx_bytes": &structs.StatValue{
+					Desc:            "Rx Bytes",
+					IntNumeratorVal: uint64ToInt64Ptr(&rxBytes),
+					Unit:            "Bytes",
+				},
+			},
+		},
+		Timestamp: timestamp,
+	}
+	readAerCounters(pf.Address).statAttributes(deviceStats.Stats.Attributes, "pf_")
+	return deviceStats
+}
+
+// pfAerStats reports the aer counters of a pf, summarized by its correctable
+// errors
+func pfAerStats(pf *host.Pf, timestamp time.Time) *device.DeviceStats {
+	counters := readAerCounters(pf.Address)
+	if counters == nil {
+		return nil
+	}
+	correctable := counters[aerCorrectable]
+	deviceStats := &device.DeviceStats{
+		Summary: &structs.StatValue{
+			Desc:            "PF AER correctable errors",
+			IntNumeratorVal: uint64ToInt64Ptr(&correctable),
+			Unit:            "Errors",
+		},
+		Stats: &structs.StatObject{
+			Attributes: make(map[string]*structs.StatValue),
+		},
+		Timestamp: timestamp,
+	}
+	counters.statAttributes(deviceStats.Stats.Attributes, "pf_")
+	return deviceStats
+}
+
 func uintToInt64Ptr(u *uint) *int64 {
 	if u == nil {
 		return nil
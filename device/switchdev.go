@@ -0,0 +1,202 @@
+package vf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/nomad/plugins/shared/structs"
+	"github.com/vishvananda/netlink"
+
+	"github.com/david-gurley/host"
+)
+
+const (
+	eswitchModeLegacy    = "legacy"
+	eswitchModeSwitchdev = "switchdev"
+
+	// attributes for device groups (eswitch)
+	EswitchModeAttr  = "pf_eswitch_mode"
+	RepresentorsAttr = "representors"
+	RepresentorAttr  = "representor"
+
+	// representorEnv prefixes the environment variables holding the
+	// representor of every reserved vf, indexed like DEVICE_VF_<vendor>_<i>
+	representorEnv = "VF_REPRESENTOR_"
+)
+
+var (
+	// vfRepresentorPattern matches the phys_port_name of a vf representor,
+	// e.g. pf0vf3, optionally prefixed with the controller, e.g. c1pf0vf3
+	vfRepresentorPattern = regexp.MustCompile(`^(?:c\d+)?pf(\d+)vf(\d+)$`)
+	// uplinkPortPattern matches the phys_port_name of a pf uplink, e.g. p0
+	uplinkPortPattern = regexp.MustCompile(`^p(\d+)$`)
+)
+
+// validateEswitchMode checks an eswitch_mode option, empty leaves the mode
+// alone
+func validateEswitchMode(mode string) error {
+	switch mode {
+	case "", eswitchModeLegacy, eswitchModeSwitchdev:
+		return nil
+	}
+	return fmt.Errorf("invalid eswitch_mode %q, must be %q or %q", mode, eswitchModeLegacy, eswitchModeSwitchdev)
+}
+
+// eswitchMode returns the devlink eswitch mode of a pf, or an empty string
+// when the pf has no eswitch
+func eswitchMode(address string) (string, error) {
+	dev, err := netlink.DevLinkGetDeviceByName("pci", address)
+	if err != nil {
+		return "", err
+	}
+	return dev.Attrs.Eswitch.Mode, nil
+}
+
+// setEswitchMode switches the eswitch of a pf to the given mode, unless it is
+// already in it
+func setEswitchMode(address string, mode string) error {
+	dev, err := netlink.DevLinkGetDeviceByName("pci", address)
+	if err != nil {
+		return err
+	}
+	if dev.Attrs.Eswitch.Mode == mode {
+		return nil
+	}
+	return netlink.DevLinkSetEswitchMode(dev, mode)
+}
+
+// eswitchModes returns the eswitch mode of every sriov capable pf. Pfs whose
+// driver has no eswitch are left out.
+func (d *VfDevicePlugin) eswitchModes(pfsMap map[string]*host.Pf) map[string]string {
+	modes := make(map[string]string)
+	for address, pf := range pfsMap {
+		if pf.TotalVfs == 0 {
+			continue
+		}
+		mode, err := eswitchMode(address)
+		if err != nil {
+			d.logger.Trace("failed to get pf eswitch mode", "pf", address, "error", err)
+			continue
+		}
+		if mode != "" {
+			modes[address] = mode
+		}
+	}
+	return modes
+}
+
+// netdevAttr reads a sysfs attribute of a network interface
+func netdevAttr(interfaceName string, attr string) string {
+	value, err := host.ReadFileString(filepath.Join(sysfsRoot, "class", "net", interfaceName, attr))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(value)
+}
+
+// pfNumber returns the number of a pf on its eswitch: the number of its uplink
+// port name, e.g. 1 for p1, or its pci function number
+func pfNumber(address string, interfaceName string) int {
+	if m := uplinkPortPattern.FindStringSubmatch(netdevAttr(interfaceName, "phys_port_name")); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		return n
+	}
+	if i := strings.LastIndex(address, "."); i >= 0 {
+		if n, err := strconv.Atoi(address[i+1:]); err == nil {
+			return n
+		}
+	}
+	return -1
+}
+
+// vfRepresentors maps the address of every vf of a pf in switchdev mode to
+// its representor. A representor shares the phys_switch_id of the pf uplink
+// and is named pf<N>vf<M> by phys_port_name.
+func vfRepresentors(pfsMap map[string]*host.Pf, modes map[string]string) map[string]string {
+	representors := make(map[string]string)
+	type eswitchPort struct {
+		switchID string
+		pfNumber int
+	}
+	pfs := make(map[eswitchPort]string)
+	for address, mode := range modes {
+		pf := pfsMap[address]
+		if mode != eswitchModeSwitchdev || pf == nil || pf.InterfaceName == "" {
+			continue
+		}
+		switchID := netdevAttr(pf.InterfaceName, "phys_switch_id")
+		if switchID == "" {
+			continue
+		}
+		pfs[eswitchPort{switchID, pfNumber(address, pf.InterfaceName)}] = address
+	}
+	if len(pfs) == 0 {
+		return representors
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(sysfsRoot, "class", "net"))
+	if err != nil {
+		return representors
+	}
+	vfs := make(map[string]map[int]string)
+	for _, e := range entries {
+		m := vfRepresentorPattern.FindStringSubmatch(netdevAttr(e.Name(), "phys_port_name"))
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[1])
+		pfAddress, ok := pfs[eswitchPort{netdevAttr(e.Name(), "phys_switch_id"), n}]
+		if !ok {
+			continue
+		}
+		if vfs[pfAddress] == nil {
+			vfs[pfAddress] = vfAddresses(pfAddress)
+		}
+		index, _ := strconv.Atoi(m[2])
+		if address, ok := vfs[pfAddress][index]; ok {
+			representors[address] = e.Name()
+		}
+	}
+	return representors
+}
+
+// eswitchAttributes adds the eswitch mode shared by the pfs of a device group,
+// whether every device has a representor, and the representor of a single
+// device group
+func eswitchAttributes(vfs host.Vfs, modes map[string]string, representors map[string]string, attrs map[string]*structs.Attribute) {
+	mode, ok := modes[vfs[0].PfAddress]
+	all := true
+	for _, vf := range vfs {
+		if modes[vf.PfAddress] != mode {
+			ok = false
+		}
+		if representors[vf.Address] == "" {
+			all = false
+		}
+	}
+	if !ok {
+		return
+	}
+	attrs[EswitchModeAttr] = &structs.Attribute{String: &mode}
+	if mode != eswitchModeSwitchdev {
+		return
+	}
+	attrs[RepresentorsAttr] = &structs.Attribute{Bool: &all}
+	if rep := representors[vfs[0].Address]; len(vfs) == 1 && rep != "" {
+		attrs[RepresentorAttr] = &structs.Attribute{String: &rep}
+	}
+}
+
+// representorEnvs returns the representor of every reserved vf that has one
+func representorEnvs(vfs host.Vfs, representors map[string]string) map[string]string {
+	envs := make(map[string]string)
+	for i, vf := range vfs {
+		if rep := representors[vf.Address]; rep != "" {
+			envs[fmt.Sprintf("%s%d", representorEnv, i)] = rep
+		}
+	}
+	return envs
+}
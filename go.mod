@@ -6,7 +6,10 @@ require (
 	github.com/david-gurley/host v1.0.33
 	github.com/hashicorp/go-hclog v0.9.1
 	github.com/hashicorp/nomad v0.10.0-beta1.0.20191119152219-a9490506dc2a
+	github.com/jaypipes/pcidb v0.6.0
 	github.com/kr/pretty v0.1.0
+	github.com/vishvananda/netlink v1.1.0
+	golang.org/x/sys v0.0.0-20210510120138-977fb7262007
 )
 
 require (
@@ -37,7 +40,6 @@ require (
 	github.com/hashicorp/yamux v0.0.0-20181012175058-2f1d1f20f75d // indirect
 	github.com/hpcloud/tail v1.0.0 // indirect
 	github.com/jaypipes/ghw v0.8.0 // indirect
-	github.com/jaypipes/pcidb v0.6.0 // indirect
 	github.com/jinzhu/copier v0.3.2 // indirect
 	github.com/kr/text v0.1.0 // indirect
 	github.com/mitchellh/copystructure v1.0.0 // indirect
@@ -53,13 +55,11 @@ require (
 	github.com/shirou/gopsutil v0.0.0-00010101000000-000000000000 // indirect
 	github.com/shirou/w32 v0.0.0-20160930032740-bb4de0191aa4 // indirect
 	github.com/ugorji/go v0.0.0-00010101000000-000000000000 // indirect
-	github.com/vishvananda/netlink v1.1.0 // indirect
 	github.com/vishvananda/netns v0.0.0-20191106174202-0a2b9b5464df // indirect
 	github.com/vmihailenco/msgpack v3.3.3+incompatible // indirect
 	github.com/zclconf/go-cty v1.1.0 // indirect
 	golang.org/x/crypto v0.0.0-20191029031824-8986dd9e96cf // indirect
 	golang.org/x/net v0.0.0-20190620200207-3b0461eec859 // indirect
-	golang.org/x/sys v0.0.0-20210510120138-977fb7262007 // indirect
 	golang.org/x/text v0.3.2 // indirect
 	google.golang.org/appengine v1.4.0 // indirect
 	google.golang.org/genproto v0.0.0-20190404172233-64821d5d2107 // indirect